@@ -5,8 +5,13 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"os"
+
 	log "github.com/sirupsen/logrus"
 
+	"github.com/vatine/gochecker/pkg/config"
 	"github.com/vatine/gochecker/pkg/deciders"
 	"github.com/vatine/gochecker/pkg/pkgdata"
 )
@@ -41,26 +46,60 @@ func clean(pkg pkgdata.Package) bool {
 }
 
 func main() {
-	pkgdata.SetStoragePath("/tmp/go_data")
-	pkgdata.LoadLatest()
+	var dryRun bool
+
+	flag.BoolVar(&dryRun, "dry-run", false, "Only log what would be deleted.")
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], config.DataFlags, os.Stdout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+	if cfg.Verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	store, err := pkgdata.NewSnapshotStore(cfg.DataDir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("failed to open DB")
+	}
+	if err := store.LoadLatest(); err != nil {
+		log.WithFields(log.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Loading data")
+	}
 
 	var toDel []string
 
-	for pkg := range pkgdata.AllPackages() {
+	for pkg := range store.Iterate(context.Background()) {
 		if clean(pkg) {
 			toDel = append(toDel, pkg.Name)
 		}
 	}
 
+	if dryRun {
+		log.WithFields(log.Fields{
+			"would-zap": len(toDel),
+		}).Info("# pkgs not deleted, dry run")
+		return
+	}
+
 	for _, name := range toDel {
-		pkgdata.PurgePackage(name)
+		store.Purge(name)
 	}
 
 	log.WithFields(log.Fields{
 		"zapped": len(toDel),
 	}).Info("# pkgs deleted")
 
-	err := pkgdata.Save()
+	err = store.Save()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -0,0 +1,158 @@
+// Show what changed between two pkgdata snapshots.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/config"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func status(passed bool) string {
+	if passed {
+		return "pass"
+	}
+	return "fail"
+}
+
+func emitText(d pkgdata.Diff) {
+	fmt.Printf("Added: %d\n", len(d.Added))
+	for _, name := range d.Added {
+		fmt.Printf("  + %s\n", name)
+	}
+
+	fmt.Printf("Removed: %d\n", len(d.Removed))
+	for _, name := range d.Removed {
+		fmt.Printf("  - %s\n", name)
+	}
+
+	fmt.Printf("Changed: %d\n", len(d.Changed))
+	for _, pkg := range d.Changed {
+		fmt.Printf("  %s\n", pkg.Name)
+		for _, change := range pkg.Changes {
+			fmt.Printf("    %s: %s -> %s\n", change.Field, status(change.Was), status(change.Now))
+			if len(change.NewFailures) > 0 {
+				fmt.Printf("      new failures: %s\n", strings.Join(change.NewFailures, ", "))
+			}
+			if len(change.Fixed) > 0 {
+				fmt.Printf("      fixed: %s\n", strings.Join(change.Fixed, ", "))
+			}
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("Field\tStarted failing\tStarted passing\tTargets changed")
+	for _, s := range d.Summary() {
+		fmt.Printf("%s\t%d\t%d\t%d\n", s.Field, s.StartFailing, s.StartPassing, s.Targets)
+	}
+}
+
+func emitJSON(d pkgdata.Diff) error {
+	out := struct {
+		pkgdata.Diff
+		Summary []pkgdata.DiffSummary `json:"summary"`
+	}{d, d.Summary()}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+
+	return nil
+}
+
+// Outputs a LaTeX table summarising the diff
+func emitLaTeX(d pkgdata.Diff) {
+	fmt.Println(`\begin{table}[ht]`)
+	fmt.Println(`\caption{Changes between crawls}`)
+	fmt.Println(`\label{table:diff}`)
+	fmt.Println(`\begin{tabular}{|l|r|r|r|}`)
+	fmt.Println(` \hline`)
+
+	fmt.Printf(`  Packages added & %d & & \\`, len(d.Added))
+	fmt.Println()
+	fmt.Printf(`  Packages removed & %d & & \\`, len(d.Removed))
+	fmt.Println()
+	fmt.Printf(`  Packages changed & %d & & \\`, len(d.Changed))
+	fmt.Println()
+
+	fmt.Println(` \hline`)
+	fmt.Println(`  & Started failing & Started passing & Targets changed \\`)
+	fmt.Println(` \hline`)
+	for _, s := range d.Summary() {
+		fmt.Printf(`  %s & %d & %d & %d \\`, s.Field, s.StartFailing, s.StartPassing, s.Targets)
+		fmt.Println()
+	}
+
+	fmt.Println(` \hline`)
+	fmt.Println(`\end{tabular}`)
+	fmt.Println(`\end{table}`)
+}
+
+// Return the path to a snapshot. A bare snapshot name that is not in
+// the current directory is looked for in the data directory.
+func snapshotPath(dataDir, name string) string {
+	if _, err := os.Stat(name); err == nil || strings.ContainsRune(name, filepath.Separator) {
+		return name
+	}
+	return filepath.Join(dataDir, name)
+}
+
+func main() {
+	var format string
+
+	logrus.SetLevel(logrus.WarnLevel)
+
+	flag.StringVar(&format, "format", "text", "Output format, one of text, json or latex.")
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], config.DataFlags, os.Stdout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+	if cfg.Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: diff [-datadir dir] [-format text|json|latex] <old snapshot> <new snapshot>")
+		os.Exit(2)
+	}
+
+	old, err := pkgdata.OpenSnapshot(snapshotPath(cfg.DataDir, flag.Arg(0)))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Loading old snapshot")
+	}
+	new, err := pkgdata.OpenSnapshot(snapshotPath(cfg.DataDir, flag.Arg(1)))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Loading new snapshot")
+	}
+
+	d := pkgdata.DiffStores(old, new)
+
+	switch format {
+	case "text":
+		emitText(d)
+	case "json":
+		err = emitJSON(d)
+	case "latex":
+		emitLaTeX(d)
+	default:
+		logrus.WithFields(logrus.Fields{"format": format}).Fatal("Unknown format")
+	}
+
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Emitting diff")
+	}
+}
@@ -0,0 +1,83 @@
+// Merge pkgdata snapshots from several independent crawls into a
+// data directory, on top of the data already there.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/config"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func main() {
+	var policyName string
+
+	flag.StringVar(&policyName, "policy", "newest", "Conflict policy, one of newest, success, failure or history.")
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], config.DataFlags, os.Stdout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+	if cfg.Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	outDir := cfg.DataDir
+
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: merge [-datadir dir] [-policy p] <snapshot>...")
+		os.Exit(2)
+	}
+
+	policy, err := pkgdata.ParseConflictPolicy(policyName)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Parsing policy")
+	}
+
+	store, err := pkgdata.NewSnapshotStore(outDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": outDir,
+			"error":   err,
+		}).Fatal("Setting up data store")
+	}
+	// Save replaces the newest snapshot and the journal, so anything
+	// already in the directory has to be loaded first, or it is lost.
+	if err := store.LoadLatest(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": outDir,
+			"error":   err,
+		}).Fatal("Loading existing data")
+	}
+
+	for _, name := range flag.Args() {
+		src, err := pkgdata.OpenSnapshot(name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"snapshot": name,
+				"error":    err,
+			}).Fatal("Loading snapshot")
+		}
+
+		conflicts := pkgdata.Merge(store, src, policy)
+		for _, c := range conflicts {
+			fmt.Printf("%s\t%s\t%s\n", name, c.Name, c.Resolution)
+		}
+		logrus.WithFields(logrus.Fields{
+			"snapshot":  name,
+			"conflicts": len(conflicts),
+		}).Info("Merged")
+	}
+
+	err = store.Save()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Saving merged data")
+	}
+}
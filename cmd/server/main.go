@@ -1,59 +1,278 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/config"
 	"github.com/vatine/gochecker/pkg/handlers"
+	"github.com/vatine/gochecker/pkg/logstore"
+	"github.com/vatine/gochecker/pkg/metrics"
 	"github.com/vatine/gochecker/pkg/pkgdata"
+	"github.com/vatine/gochecker/pkg/validation"
 )
 
 // Make sure that the package data is saved every so often, in case
 // there's an unexepcted temination. Also allows for running various
 // tabulation and checks on the data periodically.
-func periodicSave(d time.Duration) {
+func periodicSave(store pkgdata.Store, d time.Duration) {
 	t := time.NewTicker(d)
 	for _ = range t.C {
-		pkgdata.Save()
+		store.Save()
 	}
 }
 
+// Work out a report endpoint the build containers can reach, from
+// the address we listen on. Unless we listen on a specific host, use
+// the first non-loopback IPv4 address we have.
+func defaultEndpoint(listen string, tls bool) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+		addrs, err := net.InterfaceAddrs()
+		if err == nil {
+			for _, addr := range addrs {
+				ipnet, ok := addr.(*net.IPNet)
+				if ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+					host = ipnet.IP.String()
+					break
+				}
+			}
+		}
+	}
+
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/api/report", scheme, net.JoinHostPort(host, port))
+}
+
+// Wait for SIGINT or SIGTERM, then shut down: stop dispatching jobs,
+// wait (up to timeout) for running builds, stop serving, and save.
+//
+// Builds report back over HTTP, so we keep serving while waiting for
+// them, and only then drain in-flight requests. Event streams never
+// finish on their own; they are closed by the server's shutdown hook.
+func shutdownOnSignal(server *http.Server, store pkgdata.Store, timeout time.Duration, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logrus.WithFields(logrus.Fields{
+		"signal": sig,
+	}).Info("Shutting down.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := validation.Drain(ctx); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"running": validation.Status().Running,
+		}).Warn("Timed out waiting for running builds.")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Draining requests.")
+	}
+
+	if err := store.Save(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Final save.")
+	}
+	close(done)
+}
+
 func main() {
-	var dataDir string
-	var image string
-	var envFile string
-	var endpoint string
-	var saveInterval time.Duration
-	var verbose bool
-
-	flag.StringVar(&dataDir, "datadir", "/tmp/go_data", "Data directory for long-term storage.")
-	flag.StringVar(&image, "image", "gobuilder:manual", "Name of the image to use for go builds")
-	flag.StringVar(&envFile, "env-file", "/tmp/go_data/env", "Name of the file to use for the environment file for the build image.")
-	flag.StringVar(&endpoint, "endpoint", "http://192.168.1.2:8080/api/report", "Endpoint for reporting build status to.")
-	flag.DurationVar(&saveInterval, "interval", time.Hour, "Time between saves")
-	flag.BoolVar(&verbose, "verbose", false, "Verbose logging")
-
-	flag.Parse()
-
-	if verbose {
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], config.ServerFlags, os.Stdout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+
+	if cfg.Verbose {
 		logrus.SetLevel(logrus.DebugLevel)
 	} else {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
-	pkgdata.SetStoragePath(dataDir)
-	go periodicSave(saveInterval)
-	pkgdata.LoadLatest()
+	store, err := pkgdata.NewSnapshotStore(cfg.DataDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Setting up data store")
+	}
+	store.SetRetention(cfg.Retention)
+	if err := store.LoadLatest(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Loading data")
+	}
+	go periodicSave(store, cfg.SaveInterval.Duration)
 
-	handlers.VC.Image = image
-	handlers.VC.EnvFile = envFile
-	handlers.VC.Endpoint = endpoint
+	handlers.Store = store
+
+	logs, err := logstore.New(cfg.DataDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Setting up log store")
+	}
+	handlers.Logs = logs
+
+	err = handlers.SetQuarantine(filepath.Join(cfg.DataDir, "quarantine"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Setting up quarantine")
+	}
+	handlers.AllowManualReports = cfg.AllowManualReports
+
+	if cfg.AuthConfig != "" {
+		handlers.Auth, err = auth.LoadConfig(cfg.AuthConfig)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"auth-config": cfg.AuthConfig,
+				"error":       err,
+			}).Fatal("Loading auth config")
+		}
+	}
+	if cfg.ReportToken != "" {
+		handlers.Auth.ReportTokens = map[string]string{"default": cfg.ReportToken}
+	}
+	if cfg.AdminToken != "" {
+		handlers.Auth.AdminTokens = map[string]string{"default": cfg.AdminToken}
+	}
+	if cfg.SigningKey != "" {
+		handlers.Auth.SigningKey = cfg.SigningKey
+	}
+	if handlers.Auth.Disabled() {
+		logrus.Warn("No authentication configured, anyone can report and save.")
+	} else if len(handlers.Auth.AdminTokens) == 0 {
+		logrus.Warn("No admin tokens configured, admin endpoints are closed.")
+	}
+
+	if cfg.Policy != "" {
+		c, err := handlers.LoadPolicyConfig(cfg.Policy)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"policy": cfg.Policy,
+				"error":  err,
+			}).Fatal("Loading validation policy")
+		}
+		c.DryRun = c.DryRun || cfg.PolicyDryRun
+		handlers.Policy, err = handlers.NewPolicy(c, store)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"policy": cfg.Policy,
+				"error":  err,
+			}).Fatal("Setting up validation policy")
+		}
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		logrus.Fatal("Need both --tls-cert and --tls-key for TLS.")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultEndpoint(cfg.Listen, cfg.TLSCert != "")
+		logrus.WithFields(logrus.Fields{
+			"endpoint": cfg.Endpoint,
+		}).Info("Using default report endpoint.")
+	}
+
+	handlers.VC.Image = cfg.Image
+	handlers.VC.EnvFile = cfg.EnvFile
+	handlers.VC.Endpoint = cfg.Endpoint
+	handlers.VC.SigningKey = handlers.Auth.SigningKey
+	handlers.VC.Command = strings.Fields(cfg.Command)
+	handlers.VC.Timeout = cfg.JobTimeout.Duration
+	handlers.VC.Store = store
+	handlers.VC.Retry = validation.RetryPolicy{
+		MaxAttempts: cfg.RetryAttempts,
+		Backoff:     cfg.RetryBackoff.Duration,
+		MaxBackoff:  cfg.RetryMaxBackoff.Duration,
+	}
+	for _, token := range handlers.Auth.ReportTokens {
+		handlers.VC.ReportToken = token
+		break
+	}
+	handlers.VC.Runner, err = validation.NewRunner(cfg.Runner, handlers.VC)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"runner": cfg.Runner,
+			"error":  err,
+		}).Fatal("Setting up runner")
+	}
+	validation.JobRetention = cfg.JobRetention.Duration
+	err = validation.OpenJobs(cfg.DataDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Loading job queue")
+	}
+	handlers.VC.StartWorkers(cfg.Workers)
 
 	http.HandleFunc("/api/report", handlers.HandleStatusCallback)
 	http.HandleFunc("/api/validate", handlers.HandleValidation)
-	http.HandleFunc("/api/save", handlers.SaveHandler)
+	http.HandleFunc("/api/save", handlers.Auth.RequireAdmin(handlers.SaveHandler))
+	http.HandleFunc("/api/history", handlers.HandleHistory)
+	http.HandleFunc("/api/logs", handlers.HandleLogs)
+	http.HandleFunc("/api/package", handlers.HandlePackage)
+	http.HandleFunc("/api/module", handlers.HandleModule)
+	http.HandleFunc("/api/packages", handlers.HandlePackages)
+	http.HandleFunc("/dashboard", handlers.HandleDashboard)
+	http.HandleFunc("/metrics", metrics.Handler)
+	http.HandleFunc("/api/events", handlers.HandleEvents)
+	http.HandleFunc("/api/workers", handlers.HandleWorkers)
+	http.HandleFunc("/api/jobs", handlers.HandleJobs)
+
+	server := &http.Server{Addr: cfg.Listen}
+	server.RegisterOnShutdown(handlers.CloseEventStreams)
+	done := make(chan struct{})
+	go shutdownOnSignal(server, store, cfg.ShutdownTimeout.Duration, done)
 
-	http.ListenAndServe(":8080", nil)
+	logrus.WithFields(logrus.Fields{
+		"listen": cfg.Listen,
+		"tls":    cfg.TLSCert != "",
+	}).Info("Serving.")
+	if cfg.TLSCert != "" {
+		err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logrus.WithFields(logrus.Fields{
+			"listen": cfg.Listen,
+			"error":  err,
+		}).Fatal("Serving")
+	}
+	<-done
 }
@@ -0,0 +1,123 @@
+// Manage the pkgdata snapshots in a data directory.
+//
+// Usage:
+//
+//	snapshots [flags] list
+//	snapshots [flags] pin <snapshot> [label]
+//	snapshots [flags] unpin <snapshot>
+//	snapshots [flags] prune
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/config"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func list(store *pkgdata.SnapshotStore) error {
+	snaps, err := store.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		pin := ""
+		if snap.Pinned {
+			pin = "pinned"
+			if snap.Label != "" {
+				pin = fmt.Sprintf("pinned (%s)", snap.Label)
+			}
+		}
+		fmt.Printf("%s\t%s\n", snap.Name, pin)
+	}
+
+	return nil
+}
+
+func prune(store *pkgdata.SnapshotStore, policy pkgdata.RetentionPolicy, dryRun bool) error {
+	if policy.KeepAll() {
+		return fmt.Errorf("No retention policy given, refusing to prune")
+	}
+
+	if dryRun {
+		snaps, err := store.Snapshots()
+		if err != nil {
+			return err
+		}
+		_, remove := policy.Select(snaps)
+		for _, snap := range remove {
+			fmt.Printf("would remove %s\n", snap.Name)
+		}
+		return nil
+	}
+
+	removed, err := store.PruneWith(policy)
+	for _, snap := range removed {
+		fmt.Printf("removed %s\n", snap.Name)
+	}
+	return err
+}
+
+func snapshotFlags(fs *flag.FlagSet, c *config.Config) {
+	config.DataFlags(fs, c)
+	config.RetentionFlags(fs, c)
+}
+
+func main() {
+	var dryRun bool
+
+	flag.BoolVar(&dryRun, "dry-run", false, "Only show what pruning would remove.")
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], snapshotFlags, os.Stdout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+	dataDir := cfg.DataDir
+	policy := cfg.Retention
+
+	store, err := pkgdata.NewSnapshotStore(dataDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": dataDir,
+			"error":   err,
+		}).Fatal("Setting up data store")
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing sub-command, one of list, pin, unpin or prune.")
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "list":
+		err = list(store)
+	case args[0] == "pin" && len(args) == 2:
+		err = store.Pin(args[1], "")
+	case args[0] == "pin" && len(args) == 3:
+		err = store.Pin(args[1], args[2])
+	case args[0] == "unpin" && len(args) == 2:
+		err = store.Unpin(args[1])
+	case args[0] == "prune":
+		err = prune(store, policy, dryRun)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sub-command or wrong arguments, %v\n", args)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"command": args[0],
+			"error":   err,
+		}).Fatal("Failed")
+	}
+}
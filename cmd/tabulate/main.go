@@ -1,20 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math"
+	"os"
 	"sort"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/vatine/gochecker/pkg/config"
 	"github.com/vatine/gochecker/pkg/pkgdata"
 )
 
 type accumulator struct {
 	seen                     float64
+	pending                  float64
 	downloadFailed           float64
+	timedOut                 float64
+	infraFailed              float64
 	buildSuccess             float64
 	testSuccess              float64
 	noTestTargets            float64
@@ -33,6 +39,7 @@ type accumulator struct {
 	failedTestTargetsFailed  []float64
 	passedBuildFailedTests   []float64
 	versionCount             map[string]int64
+	failureCauses            map[string]map[string]float64
 }
 
 type mostData struct {
@@ -125,7 +132,7 @@ func (a *accumulator) process(p pkgdata.PackageStats) {
 	}
 
 	a.buildFractions = append(a.buildFractions, buildFraction)
-	a.buildTargetsFailed = append(a.buildTargetsFailed)
+	a.buildTargetsFailed = append(a.buildTargetsFailed, failedBuildCount)
 	a.buildTargetsFmtFailed = append(a.buildTargetsFmtFailed, failedFmtCount)
 
 	a.testFractions = append(a.testFractions, testFraction)
@@ -141,6 +148,12 @@ func (a *accumulator) process(p pkgdata.PackageStats) {
 		a.allFmtOK += 1.0
 	}
 	a.vetTargetsFailed = append(a.vetTargetsFailed, float64(failedVetCount))
+
+	for _, f := range p.Failures {
+		if causes, ok := a.failureCauses[f.Stage]; ok {
+			causes[f.Cause] += 1.0
+		}
+	}
 }
 
 func meanAndDev(data []float64) (mean, stddev float64) {
@@ -191,18 +204,34 @@ func newAccumulator() *accumulator {
 	var rv accumulator
 
 	rv.versionCount = make(map[string]int64)
+	rv.failureCauses = make(map[string]map[string]float64)
+	for _, stage := range []string{pkgdata.StageBuild, pkgdata.StageTest, pkgdata.StageVet} {
+		rv.failureCauses[stage] = make(map[string]float64)
+	}
 
 	return &rv
 }
 
 // Process a batch of package data, return two accumulators, one for
 // successful and one for failed downloads.
-func statsRun() (accumulator, accumulator) {
-	pkgChan := pkgdata.AllPackages()
+func statsRun(store pkgdata.Store) (accumulator, accumulator) {
+	pkgChan := store.Iterate(context.Background())
 	rv := newAccumulator()
 	fails := newAccumulator()
 
 	for data := range pkgChan {
+		if data.Pending {
+			rv.pending += 1.0
+			continue
+		}
+		switch data.Stats.Outcome {
+		case pkgdata.OutcomeTimedOut:
+			rv.timedOut += 1.0
+			continue
+		case pkgdata.OutcomeInfraFailure:
+			rv.infraFailed += 1.0
+			continue
+		}
 		if data.Stats.DownloadSucceeded {
 			rv.versionCount[moduleFromPackage(data.Name)] += 1
 			rv.process(data.Stats)
@@ -259,8 +288,14 @@ func (a accumulator) emitBuildStats() {
 
 	fmt.Printf(`  Packages processed & %.0f \\`, a.seen)
 	fmt.Println()
+	fmt.Printf(`  Packages pending & %.0f \\`, a.pending)
+	fmt.Println()
 	fmt.Printf(`  Packages failed to download & %.0f \\`, a.downloadFailed)
 	fmt.Println()
+	fmt.Printf(`  Packages timed out & %.0f \\`, a.timedOut)
+	fmt.Println()
+	fmt.Printf(`  Packages never reported (infrastructure) & %.0f \\`, a.infraFailed)
+	fmt.Println()
 
 	fmt.Printf(`  No build failures & %.0f (%f\%%) \\`, a.buildSuccess, percent(a.seen, a.buildSuccess))
 	fmt.Println()
@@ -391,6 +426,33 @@ func (a accumulator) emitTestStats() {
 	fmt.Println(`\end{table}`)
 }
 
+// Outputs a LaTeX table with the number of failed targets per
+// failure cause and stage
+func (a accumulator) emitFailureCauses() {
+	fmt.Println(`\begin{table}[ht]`)
+	fmt.Println(`\caption{Failure causes}`)
+	fmt.Println(`\label{table:causes}`)
+	fmt.Println(`\begin{tabular}{|l|r|r|r|}`)
+	fmt.Println(` \hline`)
+	fmt.Println(`  Cause & Build & Test & Vet \\`)
+	fmt.Println(` \hline`)
+
+	for _, cause := range pkgdata.FailureCauses {
+		build := a.failureCauses[pkgdata.StageBuild][cause]
+		test := a.failureCauses[pkgdata.StageTest][cause]
+		vet := a.failureCauses[pkgdata.StageVet][cause]
+		if build+test+vet == 0.0 {
+			continue
+		}
+		fmt.Printf(`  %s & %.0f & %.0f & %.0f \\`, cause, build, test, vet)
+		fmt.Println()
+	}
+
+	fmt.Println(` \hline`)
+	fmt.Println(`\end{tabular}`)
+	fmt.Println(`\end{table}`)
+}
+
 func (a accumulator) emitVersionTable(n int, fail bool) {
 	most := a.mostFrequentModules(n)
 	failMsg := ""
@@ -415,29 +477,49 @@ func (a accumulator) emitVersionTable(n int, fail bool) {
 
 }
 
-func statsTables() {
-	acc, fails := statsRun()
+func statsTables(store pkgdata.Store, topVersions int) {
+	acc, fails := statsRun(store)
 
 	acc.emitBuildStats()
 	fmt.Println()
 	acc.emitTestStats()
 	fmt.Println()
-	acc.emitVersionTable(10, false)
+	acc.emitFailureCauses()
+	fmt.Println()
+	acc.emitVersionTable(topVersions, false)
 
-	fails.emitVersionTable(10, true)
+	fails.emitVersionTable(topVersions, true)
 }
 
 func main() {
-	var dataDir string
-
 	logrus.SetLevel(logrus.WarnLevel)
 
-	flag.StringVar(&dataDir, "datadir", "/tmp/go_data", "Data directory for long-term storage.")
-
-	flag.Parse()
+	cfg, printed, err := config.Parse(flag.CommandLine, os.Args[1:], config.ReportFlags, os.Stdout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Reading configuration")
+	}
+	if printed {
+		return
+	}
+	if cfg.Verbose {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
 
-	pkgdata.SetStoragePath(dataDir)
-	pkgdata.LoadLatest()
+	store, err := pkgdata.NewSnapshotStore(cfg.DataDir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Setting up data store")
+	}
+	if err := store.LoadLatest(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"datadir": cfg.DataDir,
+			"error":   err,
+		}).Fatal("Loading data")
+	}
 
-	statsTables()
+	statsTables(store, cfg.Report.TopVersions)
 }
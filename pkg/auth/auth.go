@@ -0,0 +1,165 @@
+// Package for authenticating build reports and admin requests.
+//
+// Builders authenticate with a per-worker bearer token. On top of
+// that, each dispatched job is handed a job key, derived from a
+// server-side signing key, the job ID and the package name, and the
+// builder signs its report with that key. That way a report can only
+// be made for a job by someone that was handed that job.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The header carrying the payload signature.
+const SignatureHeader = "X-Gochecker-Signature"
+
+const signaturePrefix = "sha256="
+
+var ErrNoCredentials = errors.New("No credentials")
+var ErrBadCredentials = errors.New("Bad credentials")
+var ErrBadSignature = errors.New("Bad payload signature")
+var ErrNoAdminTokens = errors.New("No admin tokens configured")
+
+// Authentication configuration. Any part left empty is not checked.
+type Config struct {
+	// Bearer tokens for report submission, by worker name.
+	ReportTokens map[string]string `json:"reportTokens,omitempty"`
+	// Bearer tokens for admin endpoints, by admin name.
+	AdminTokens map[string]string `json:"adminTokens,omitempty"`
+	// Key that job keys are derived from.
+	SigningKey string `json:"signingKey,omitempty"`
+}
+
+// Load an authentication configuration from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	var rv Config
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rv, err
+	}
+
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
+
+// Return true if nothing at all is checked.
+func (c Config) Disabled() bool {
+	return len(c.ReportTokens) == 0 && len(c.AdminTokens) == 0 && c.SigningKey == ""
+}
+
+// Derive the key a builder should sign its report for pkg, in answer
+// to job jobID, with. Each job gets its own key, so holding the key
+// for one job of a package does not allow reporting for later ones.
+func JobKey(signingKey, jobID, pkg string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(jobID + "\x00" + pkg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the signature of body, made with key, in the form used in
+// the signature header.
+func Sign(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the bearer token of a request against a set of tokens,
+// returning the name the token belongs to.
+func checkToken(r *http.Request, tokens map[string]string) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", ErrNoCredentials
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	for name, want := range tokens {
+		if hmac.Equal([]byte(token), []byte(want)) {
+			return name, nil
+		}
+	}
+
+	return "", ErrBadCredentials
+}
+
+// Check that a request comes from a known builder, returning the
+// worker name (empty if tokens are not configured).
+func (c Config) CheckReporter(r *http.Request) (string, error) {
+	if len(c.ReportTokens) == 0 {
+		return "", nil
+	}
+	return checkToken(r, c.ReportTokens)
+}
+
+// Check that a report body for pkg, answering job jobID, is signed
+// with the job key for that job.
+func (c Config) CheckSignature(r *http.Request, body []byte, jobID, pkg string) error {
+	if c.SigningKey == "" {
+		return nil
+	}
+
+	want := Sign(JobKey(c.SigningKey, jobID, pkg), body)
+	got := r.Header.Get(SignatureHeader)
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// Check that a request comes from an admin, returning the admin name
+// (empty if authentication is disabled). With no admin tokens, but
+// other authentication configured, admin requests are all denied;
+// locking down reports should not leave the admin endpoints open.
+func (c Config) CheckAdmin(r *http.Request) (string, error) {
+	if c.Disabled() {
+		return "", nil
+	}
+	if len(c.AdminTokens) == 0 {
+		return "", ErrNoAdminTokens
+	}
+	return checkToken(r, c.AdminTokens)
+}
+
+// Wrap a handler so it is only reachable with an admin token.
+func (c Config) RequireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := c.CheckAdmin(r); err != nil {
+			Deny(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Wrap a handler so it is only reachable with a report token.
+func (c Config) RequireReporter(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := c.CheckReporter(r); err != nil {
+			Deny(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Respond to a request that failed authentication.
+func Deny(w http.ResponseWriter, err error) {
+	if err == ErrNoCredentials {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	fmt.Fprintln(w, err)
+}
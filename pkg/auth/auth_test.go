@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckReporter(t *testing.T) {
+	c := Config{ReportTokens: map[string]string{"worker1": "s3cret"}}
+
+	cases := []struct {
+		header string
+		worker string
+		err    error
+	}{
+		{"Bearer s3cret", "worker1", nil},
+		{"Bearer wrong", "", ErrBadCredentials},
+		{"", "", ErrNoCredentials},
+		{"Basic s3cret", "", ErrNoCredentials},
+	}
+
+	for ix, tc := range cases {
+		r := httptest.NewRequest("POST", "/api/report", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		worker, err := c.CheckReporter(r)
+		if worker != tc.worker || err != tc.err {
+			t.Errorf("Case #%d, got %q, %v, want %q, %v", ix, worker, err, tc.worker, tc.err)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/api/report", nil)
+	if _, err := (Config{}).CheckReporter(r); err != nil {
+		t.Errorf("No tokens configured, got %v", err)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	c := Config{SigningKey: "server-key"}
+	body := []byte(`{"package": "example.com/code@v1.0.0"}`)
+
+	cases := []struct {
+		key string
+		job string
+		pkg string
+		err error
+	}{
+		{JobKey("server-key", "job1", "example.com/code@v1.0.0"), "job1", "example.com/code@v1.0.0", nil},
+		{JobKey("server-key", "job1", "example.com/other@v1.0.0"), "job1", "example.com/code@v1.0.0", ErrBadSignature},
+		{JobKey("server-key", "job1", "example.com/code@v1.0.0"), "job2", "example.com/code@v1.0.0", ErrBadSignature},
+		{JobKey("wrong-key", "job1", "example.com/code@v1.0.0"), "job1", "example.com/code@v1.0.0", ErrBadSignature},
+	}
+
+	for ix, tc := range cases {
+		r := httptest.NewRequest("POST", "/api/report", nil)
+		r.Header.Set(SignatureHeader, Sign(tc.key, body))
+		if err := c.CheckSignature(r, body, tc.job, tc.pkg); err != tc.err {
+			t.Errorf("Case #%d, got %v, want %v", ix, err, tc.err)
+		}
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	cases := []struct {
+		c      Config
+		header string
+		admin  string
+		err    error
+	}{
+		{Config{}, "", "", nil},
+		{Config{AdminTokens: map[string]string{"me": "s3cret"}}, "Bearer s3cret", "me", nil},
+		{Config{AdminTokens: map[string]string{"me": "s3cret"}}, "", "", ErrNoCredentials},
+		{Config{ReportTokens: map[string]string{"worker1": "s3cret"}}, "Bearer s3cret", "", ErrNoAdminTokens},
+		{Config{SigningKey: "server-key"}, "", "", ErrNoAdminTokens},
+	}
+
+	for ix, tc := range cases {
+		r := httptest.NewRequest("POST", "/api/save", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		admin, err := tc.c.CheckAdmin(r)
+		if admin != tc.admin || err != tc.err {
+			t.Errorf("Case #%d, got %q, %v, want %q, %v", ix, admin, err, tc.admin, tc.err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package for the configuration file shared by all commands.
+//
+// The file is JSON. Anything not in the file keeps its default value,
+// and flags given on the command line override the file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+// A time.Duration that is written as, and read from, a string like
+// "1h30m" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Options for the tables cmd/tabulate produces.
+type ReportConfig struct {
+	// Number of modules to list in the "most versions" tables.
+	TopVersions int `json:"topVersions"`
+}
+
+// Configuration for all commands. Each command only looks at the parts
+// it needs.
+type Config struct {
+	DataDir string `json:"datadir"`
+	Verbose bool   `json:"verbose,omitempty"`
+
+	Listen          string   `json:"listen"`
+	TLSCert         string   `json:"tlsCert,omitempty"`
+	TLSKey          string   `json:"tlsKey,omitempty"`
+	Image           string   `json:"image"`
+	EnvFile         string   `json:"envFile"`
+	Endpoint        string   `json:"endpoint,omitempty"`
+	Runner          string   `json:"runner"`
+	Command         string   `json:"command,omitempty"`
+	Workers         int      `json:"workers"`
+	JobTimeout      Duration `json:"jobTimeout"`
+	JobRetention    Duration `json:"jobRetention"`
+	RetryAttempts   int      `json:"retryAttempts"`
+	RetryBackoff    Duration `json:"retryBackoff"`
+	RetryMaxBackoff Duration `json:"retryMaxBackoff"`
+	SaveInterval    Duration `json:"saveInterval"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	Retention pkgdata.RetentionPolicy `json:"retention"`
+
+	AuthConfig         string `json:"authConfig,omitempty"`
+	ReportToken        string `json:"reportToken,omitempty"`
+	AdminToken         string `json:"adminToken,omitempty"`
+	SigningKey         string `json:"signingKey,omitempty"`
+	AllowManualReports bool   `json:"allowManualReports,omitempty"`
+
+	Policy       string `json:"policy,omitempty"`
+	PolicyDryRun bool   `json:"policyDryRun,omitempty"`
+
+	Report ReportConfig `json:"report"`
+}
+
+// Return the built-in defaults.
+func Default() Config {
+	return Config{
+		DataDir:         "/tmp/go_data",
+		Listen:          ":8080",
+		Image:           "gobuilder:manual",
+		Runner:          "docker",
+		EnvFile:         "/tmp/go_data/env",
+		Workers:         3,
+		JobTimeout:      Duration{time.Hour},
+		JobRetention:    Duration{24 * time.Hour},
+		RetryAttempts:   3,
+		RetryBackoff:    Duration{time.Minute},
+		RetryMaxBackoff: Duration{30 * time.Minute},
+		SaveInterval:    Duration{time.Hour},
+		ShutdownTimeout: Duration{5 * time.Minute},
+		Report:          ReportConfig{TopVersions: 10},
+	}
+}
+
+// Load a configuration file, on top of the defaults. Unknown keys are
+// an error, so a misspelt key is not silently ignored.
+func Load(path string) (Config, error) {
+	rv := Default()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rv, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&rv)
+	if err != nil {
+		return rv, fmt.Errorf("%s: %v", path, err)
+	}
+	return rv, nil
+}
+
+// Write the configuration, as JSON.
+func (c Config) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// What secrets are replaced with when printing a configuration.
+const redacted = "(redacted)"
+
+// Return a copy of the configuration with tokens and keys replaced,
+// safe to print.
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.ReportToken, &c.AdminToken, &c.SigningKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return c
+}
+
+// Register the flags shared by all commands.
+func DataFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.DataDir, "datadir", c.DataDir, "Data directory for long-term storage.")
+	fs.BoolVar(&c.Verbose, "verbose", c.Verbose, "Verbose logging")
+}
+
+// Register the snapshot retention flags.
+func RetentionFlags(fs *flag.FlagSet, c *Config) {
+	fs.IntVar(&c.Retention.KeepLast, "keep-last", c.Retention.KeepLast, "Number of most recent snapshots to keep, 0 to not prune on this.")
+	fs.IntVar(&c.Retention.KeepDaily, "keep-daily", c.Retention.KeepDaily, "Number of days to keep one snapshot per day for.")
+	fs.IntVar(&c.Retention.KeepWeekly, "keep-weekly", c.Retention.KeepWeekly, "Number of weeks to keep one snapshot per week for.")
+}
+
+// Register the flags for cmd/server.
+func ServerFlags(fs *flag.FlagSet, c *Config) {
+	DataFlags(fs, c)
+	RetentionFlags(fs, c)
+
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address to listen on.")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file, serve HTTPS if set (needs --tls-key).")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS key file.")
+	fs.StringVar(&c.Image, "image", c.Image, "Name of the image to use for go builds")
+	fs.StringVar(&c.EnvFile, "env-file", c.EnvFile, "Name of the file to use for the environment file for the build image.")
+	fs.StringVar(&c.Endpoint, "endpoint", c.Endpoint, "Endpoint for reporting build status to, by default worked out from the listen address.")
+	fs.StringVar(&c.Runner, "runner", c.Runner, "How to run builds, one of docker, podman, local or fake.")
+	fs.StringVar(&c.Command, "command", c.Command, "Command the local runner runs, given module, version and report endpoint as arguments.")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "Number of builds to run at the same time.")
+	fs.DurationVar(&c.JobTimeout.Duration, "job-timeout", c.JobTimeout.Duration, "How long a build may run before it is killed, 0 for no limit.")
+	fs.DurationVar(&c.JobRetention.Duration, "job-retention", c.JobRetention.Duration, "How long to keep jobs that finished without a report, in case one turns up late.")
+	fs.IntVar(&c.RetryAttempts, "retry-attempts", c.RetryAttempts, "Most attempts at a build that ends without a report.")
+	fs.DurationVar(&c.RetryBackoff.Duration, "retry-backoff", c.RetryBackoff.Duration, "Wait before retrying a build that ended without a report, doubled for each further retry.")
+	fs.DurationVar(&c.RetryMaxBackoff.Duration, "retry-max-backoff", c.RetryMaxBackoff.Duration, "Longest wait between attempts at a build.")
+	fs.DurationVar(&c.SaveInterval.Duration, "interval", c.SaveInterval.Duration, "Time between saves")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "How long to wait for running builds, and for in-flight requests, on shutdown.")
+	fs.StringVar(&c.AuthConfig, "auth-config", c.AuthConfig, "JSON file with report tokens, admin tokens and signing key.")
+	fs.StringVar(&c.ReportToken, "report-token", c.ReportToken, "Token builders must present to report, overrides the auth config.")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Token needed for admin endpoints, overrides the auth config.")
+	fs.StringVar(&c.SigningKey, "signing-key", c.SigningKey, "Key for deriving report signing keys, overrides the auth config.")
+	fs.BoolVar(&c.AllowManualReports, "allow-manual-reports", c.AllowManualReports, "Accept reports without a job ID, from builds started by hand.")
+	fs.StringVar(&c.Policy, "policy", c.Policy, "JSON file with the validation policy, modules it denies get a 403.")
+	fs.BoolVar(&c.PolicyDryRun, "policy-dry-run", c.PolicyDryRun, "Only log what the validation policy would deny.")
+}
+
+// Register the flags for cmd/tabulate.
+func ReportFlags(fs *flag.FlagSet, c *Config) {
+	DataFlags(fs, c)
+
+	fs.IntVar(&c.Report.TopVersions, "top-versions", c.Report.TopVersions, "Number of modules to list in the most-versions tables.")
+}
+
+// Parse args with the flags register sets up, plus --config and
+// --print-config. If a config file is given, it is loaded and the
+// flags given in args are applied on top of it. With --print-config,
+// the resulting configuration is written to out, with secrets
+// redacted.
+//
+// Flags in fs that register does not know about are left alone.
+func Parse(fs *flag.FlagSet, args []string, register func(*flag.FlagSet, *Config), out io.Writer) (Config, bool, error) {
+	var path string
+	var print bool
+
+	rv := Default()
+	fs.StringVar(&path, "config", "", "JSON configuration file, flags override its values.")
+	fs.BoolVar(&print, "print-config", false, "Print the effective configuration and exit.")
+	register(fs, &rv)
+
+	if err := fs.Parse(args); err != nil {
+		return rv, false, err
+	}
+
+	if path != "" {
+		file, err := Load(path)
+		if err != nil {
+			return rv, false, err
+		}
+
+		overrides := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		register(overrides, &file)
+		fs.Visit(func(f *flag.Flag) {
+			if err == nil && overrides.Lookup(f.Name) != nil {
+				err = overrides.Set(f.Name, f.Value.String())
+			}
+		})
+		if err != nil {
+			return rv, false, err
+		}
+		rv = file
+	}
+
+	if print {
+		return rv, true, rv.Redacted().Write(out)
+	}
+	return rv, false, nil
+}
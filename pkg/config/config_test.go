@@ -0,0 +1,123 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gochecker.json")
+	file := `{"datadir": "/data", "image": "builder:v2", "workers": 8, "saveInterval": "10m", "retention": {"keepLast": 4}}`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	c, printed, err := Parse(fs, []string{"-config", path, "-workers", "2", "-listen", ":9090"}, ServerFlags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printed {
+		t.Errorf("Printed without --print-config")
+	}
+
+	want := Default()
+	want.DataDir = "/data"
+	want.Image = "builder:v2"
+	want.Workers = 2
+	want.Listen = ":9090"
+	want.SaveInterval = Duration{10 * time.Minute}
+	want.Retention.KeepLast = 4
+	if c != want {
+		t.Errorf("Got %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		file string
+		ok   bool
+	}{
+		{`{"workers": 8, "retention": {"keepLast": 4}}`, true},
+		{`{"wokers": 8}`, false},
+		{`{"retention": {"keepLats": 4}}`, false},
+	}
+
+	for ix, c := range cases {
+		path := filepath.Join(dir, "gochecker.json")
+		if err := ioutil.WriteFile(path, []byte(c.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); (err == nil) != c.ok {
+			t.Errorf("Case #%d, got error %v, want ok %v", ix, err, c.ok)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var out bytes.Buffer
+
+	fs := flag.NewFlagSet("tabulate", flag.ContinueOnError)
+	c, printed, err := Parse(fs, []string{"-print-config", "-top-versions", "5"}, ReportFlags, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printed {
+		t.Errorf("Expected --print-config to print")
+	}
+
+	fs = flag.NewFlagSet("tabulate", flag.ContinueOnError)
+	path := filepath.Join(os.TempDir(), "gochecker-printed.json")
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	again, _, err := Parse(fs, []string{"-config", path}, ReportFlags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != c || again.Report.TopVersions != 5 {
+		t.Errorf("Round trip, got %+v, want %+v", again, c)
+	}
+}
+
+func TestPrintConfigRedacts(t *testing.T) {
+	var out bytes.Buffer
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	args := []string{"-print-config", "-report-token", "report-secret", "-admin-token", "admin-secret", "-signing-key", "signing-secret"}
+	c, _, err := Parse(fs, args, ServerFlags, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SigningKey != "signing-secret" {
+		t.Errorf("Parsed signing key, got %q", c.SigningKey)
+	}
+
+	for _, secret := range []string{"report-secret", "admin-secret", "signing-secret"} {
+		if bytes.Contains(out.Bytes(), []byte(secret)) {
+			t.Errorf("Printed configuration contains %s", secret)
+		}
+	}
+	if !bytes.Contains(out.Bytes(), []byte(redacted)) {
+		t.Errorf("Printed configuration does not show redacted secrets, got %s", out.String())
+	}
+}
@@ -0,0 +1,82 @@
+// Package for passing events (build reports, job lifecycle changes)
+// to anyone interested, as they happen.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event types.
+const (
+	Report      = "report"
+	JobQueued   = "job-queued"
+	JobStarted  = "job-started"
+	JobFinished = "job-finished"
+	JobFailed   = "job-failed"
+	JobTimedOut = "job-timed-out"
+	JobCanceled = "job-canceled"
+	JobRetrying = "job-retrying"
+)
+
+// How many events a subscriber can fall behind before we start
+// dropping events for it.
+const subscriberBuffer = 64
+
+// Something that happened. Package is module@version, Data is
+// anything that can be marshalled as JSON.
+type Event struct {
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Package string      `json:"package"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var subscriberLock sync.Mutex
+var subscribers = make(map[chan Event]bool)
+
+// Pass an event on to all subscribers. This never blocks; a
+// subscriber that is not keeping up misses the event.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	for c := range subscribers {
+		select {
+		case c <- e:
+		default:
+			logrus.WithFields(logrus.Fields{
+				"type":    e.Type,
+				"package": e.Package,
+			}).Debug("Dropping event for slow subscriber.")
+		}
+	}
+}
+
+// Start receiving events. Call the returned function to stop; the
+// channel is closed once that is done.
+func Subscribe() (<-chan Event, func()) {
+	c := make(chan Event, subscriberBuffer)
+
+	subscriberLock.Lock()
+	subscribers[c] = true
+	subscriberLock.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			subscriberLock.Lock()
+			delete(subscribers, c)
+			subscriberLock.Unlock()
+			close(c)
+		})
+	}
+
+	return c, cancel
+}
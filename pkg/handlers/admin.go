@@ -0,0 +1,100 @@
+package handlers
+
+// Admin endpoints for controlling the build workers and jobs.
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/validation"
+)
+
+// Most workers we let anyone ask for.
+const maxWorkers = 256
+
+// Show (GET) or change (POST) the worker pool, as JSON.
+//
+// A POST takes a "workers" query parameter to set the number of
+// workers, and/or a "dispatch" query parameter, "pause" or "resume",
+// to stop or start handing out jobs. Running jobs are never
+// interrupted. A POST needs an admin token.
+func HandleWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if _, err := Auth.CheckAdmin(r); err != nil {
+			auth.Deny(w, err)
+			return
+		}
+
+		q := r.URL.Query()
+		n, err := intParam(q.Get("workers"), -1)
+		if err != nil || n > maxWorkers || (q.Get("workers") != "" && n < 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad number of workers, %s.", q.Get("workers"))
+			return
+		}
+
+		switch q.Get("dispatch") {
+		case "":
+		case "pause":
+			validation.Pause()
+		case "resume":
+			validation.Resume()
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown dispatch action, %s.", q.Get("dispatch"))
+			return
+		}
+
+		if n >= 0 {
+			validation.SetWorkers(n)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Unexpected method, %s.", r.Method)
+		return
+	}
+
+	writeJSON(w, validation.Status())
+}
+
+// Show (GET) or cancel (POST) the job with the ID in the "id" query
+// parameter, as JSON. A POST needs an admin token, and an "action"
+// query parameter of "cancel". Jobs that have finished and been
+// reported are forgotten, and not found.
+func HandleJobs(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if _, err := Auth.CheckAdmin(r); err != nil {
+			auth.Deny(w, err)
+			return
+		}
+		if action := r.URL.Query().Get("action"); action != "cancel" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown action, %s.", action)
+			return
+		}
+		if err := validation.CancelJob(id); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, err)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Unexpected method, %s.", r.Method)
+		return
+	}
+
+	job, ok := validation.GetJob(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such job, %s", id)
+		return
+	}
+	writeJSON(w, job)
+}
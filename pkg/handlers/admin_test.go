@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/validation"
+)
+
+func TestHandleWorkers(t *testing.T) {
+	Auth = auth.Config{AdminTokens: map[string]string{"me": "secret"}}
+	defer func() { Auth = auth.Config{} }()
+	defer validation.Resume()
+
+	cases := []struct {
+		method string
+		query  string
+		token  string
+		code   int
+		paused bool
+	}{
+		{"GET", "", "", http.StatusOK, false},
+		{"POST", "?dispatch=pause", "", http.StatusUnauthorized, false},
+		{"POST", "?dispatch=pause", "secret", http.StatusOK, true},
+		{"POST", "?workers=0", "secret", http.StatusOK, true},
+		{"POST", "?dispatch=resume", "secret", http.StatusOK, false},
+		{"POST", "?workers=-1", "secret", http.StatusBadRequest, false},
+		{"POST", "?workers=100000", "secret", http.StatusBadRequest, false},
+		{"POST", "?dispatch=bogus", "secret", http.StatusBadRequest, false},
+		{"PUT", "", "secret", http.StatusMethodNotAllowed, false},
+	}
+
+	for ix, c := range cases {
+		r := httptest.NewRequest(c.method, "/api/workers"+c.query, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		HandleWorkers(w, r)
+		if w.Code != c.code {
+			t.Errorf("Case #%d, got status %d, want %d", ix, w.Code, c.code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		var got validation.QueueStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Case #%d, %v", ix, err)
+		}
+		if got.Paused != c.paused {
+			t.Errorf("Case #%d, got paused %v, want %v", ix, got.Paused, c.paused)
+		}
+	}
+}
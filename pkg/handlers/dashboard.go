@@ -0,0 +1,162 @@
+package handlers
+
+// A live HTML dashboard, showing crawl progress.
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+	"github.com/vatine/gochecker/pkg/validation"
+)
+
+// How many recent reports the dashboard shows.
+const recentCount = 20
+
+// A report, as shown on the dashboard.
+type recentReport struct {
+	Time     time.Time
+	Package  string
+	Download bool
+	Build    bool
+	Test     bool
+}
+
+var recentLock sync.Mutex
+var recent []recentReport
+
+// Remember a report for the dashboard, forgetting the oldest if we
+// have too many.
+func noteReport(name string, stats pkgdata.PackageStats) {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	recent = append(recent, recentReport{
+		Time:     time.Now(),
+		Package:  name,
+		Download: stats.DownloadSucceeded,
+		Build:    stats.AllBuildsPass,
+		Test:     stats.AllTestsPassed,
+	})
+	if len(recent) > recentCount {
+		recent = recent[len(recent)-recentCount:]
+	}
+}
+
+// Return the recent reports, newest first.
+func recentReports() []recentReport {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	rv := make([]recentReport, len(recent))
+	for ix, r := range recent {
+		rv[len(recent)-1-ix] = r
+	}
+	return rv
+}
+
+type dashboardData struct {
+	Now     time.Time
+	Summary pkgdata.Summary
+	Queue   validation.QueueStatus
+	Recent  []recentReport
+}
+
+var dashboardFuncs = template.FuncMap{
+	"percent": pkgdata.Percent,
+	"status": func(ok bool) string {
+		if ok {
+			return "pass"
+		}
+		return "fail"
+	},
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>gochecker</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #999; padding: 0.2em 0.6em; text-align: left; }
+td.num { text-align: right; }
+.pass { color: #070; }
+.fail { color: #a00; }
+</style>
+</head>
+<body>
+<h1>gochecker</h1>
+<p>As of {{.Now.Format "2006-01-02 15:04:05"}}, refreshing every 10 seconds.</p>
+
+<h2>Queue</h2>
+<table>
+<tr><td>Queued jobs</td><td class="num">{{.Queue.Queued}}</td></tr>
+<tr><td>Jobs waiting to be retried</td><td class="num">{{.Queue.Retrying}}</td></tr>
+<tr><td>Running jobs</td><td class="num">{{.Queue.Running}}</td></tr>
+<tr><td>Workers</td><td class="num">{{.Queue.Workers}}{{if .Queue.Paused}} (paused){{end}}</td></tr>
+</table>
+
+<h2>Totals</h2>
+{{with .Summary}}
+<table>
+<tr><td>Packages seen</td><td class="num">{{.Seen}}</td><td></td></tr>
+<tr><td>Pending (queued or running)</td><td class="num">{{.Pending}}</td><td class="num">{{printf "%.1f" (percent .Seen .Pending)}}%</td></tr>
+<tr><td>Downloaded</td><td class="num">{{.Downloaded}}</td><td class="num">{{printf "%.1f" (percent .Seen .Downloaded)}}%</td></tr>
+<tr><td>Failed to download</td><td class="num">{{.DownloadFailed}}</td><td class="num">{{printf "%.1f" (percent .Seen .DownloadFailed)}}%</td></tr>
+<tr><td>Timed out</td><td class="num">{{.TimedOut}}</td><td class="num">{{printf "%.1f" (percent .Seen .TimedOut)}}%</td></tr>
+<tr><td>Never reported (infrastructure)</td><td class="num">{{.InfraFailed}}</td><td class="num">{{printf "%.1f" (percent .Seen .InfraFailed)}}%</td></tr>
+<tr><td>No build failures</td><td class="num">{{.BuildSuccess}}</td><td class="num">{{printf "%.1f" (percent .Downloaded .BuildSuccess)}}%</td></tr>
+<tr><td>No test failures</td><td class="num">{{.TestSuccess}}</td><td class="num">{{printf "%.1f" (percent .Downloaded .TestSuccess)}}%</td></tr>
+<tr><td>No test targets</td><td class="num">{{.NoTestTargets}}</td><td class="num">{{printf "%.1f" (percent .Downloaded .NoTestTargets)}}%</td></tr>
+<tr><td>No vet failures</td><td class="num">{{.AllVetsPassed}}</td><td class="num">{{printf "%.1f" (percent .Downloaded .AllVetsPassed)}}%</td></tr>
+<tr><td>No fmt failures</td><td class="num">{{.AllFmtOK}}</td><td class="num">{{printf "%.1f" (percent .Downloaded .AllFmtOK)}}%</td></tr>
+</table>
+{{end}}
+
+<h2>Recent reports</h2>
+<table>
+<tr><th>Time</th><th>Package</th><th>Download</th><th>Build</th><th>Test</th></tr>
+{{range .Recent}}
+<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{.Package}}</td>
+<td class="{{status .Download}}">{{status .Download}}</td>
+<td class="{{status .Build}}">{{status .Build}}</td>
+<td class="{{status .Test}}">{{status .Test}}</td>
+</tr>
+{{else}}
+<tr><td colspan="5">No reports yet.</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// Serve the HTML dashboard.
+func HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	data := dashboardData{
+		Now:     time.Now(),
+		Summary: pkgdata.Summarise(r.Context(), Store),
+		Queue:   validation.Status(),
+		Recent:  recentReports(),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, data)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Rendering dashboard")
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+// A server-sent event stream of build reports and job lifecycle
+// events.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vatine/gochecker/pkg/events"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+// How often to send a keep-alive comment on an idle stream.
+const keepAliveInterval = 30 * time.Second
+
+// Closed when the server shuts down, to end all event streams; they
+// would otherwise keep the server from shutting down until it gives
+// up waiting. Protected by streamLock.
+var streamLock sync.Mutex
+var streamsDone = make(chan struct{})
+
+// End all open event streams, and any opened from now on. Meant to be
+// registered with http.Server.RegisterOnShutdown.
+func CloseEventStreams() {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	select {
+	case <-streamsDone:
+	default:
+		close(streamsDone)
+	}
+}
+
+func eventStreamsDone() <-chan struct{} {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	return streamsDone
+}
+
+// Return true if an event passes the filters. A prefix matches on
+// module path boundaries, as in the policy, or the whole package name.
+// A status filter only passes reports, with the same status names as
+// HandlePackages.
+func eventMatches(e events.Event, prefix, status string) bool {
+	module := strings.SplitN(e.Package, "@", 2)[0]
+	if prefix != "" && e.Package != prefix && !matchesPrefix(module, []string{prefix}) {
+		return false
+	}
+	if status == "" {
+		return true
+	}
+
+	payload, ok := e.Data.(PackagePayload)
+	if e.Type != events.Report || !ok {
+		return false
+	}
+	return matchesStatus(pkgdata.Package{Name: e.Package, Stats: payload.Data}, status)
+}
+
+// Stream events to the client, as server-sent events. The "prefix"
+// query parameter only passes events for modules at or below it,
+// and "status" only passes reports with that status (see
+// HandlePackages).
+func HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Streaming not supported")
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	status := r.URL.Query().Get("status")
+	if _, ok := statusFilters[status]; status != "" && !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown status, %s", status)
+		return
+	}
+
+	done := eventStreamsDone()
+	c, cancel := events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			if !eventMatches(e, prefix, status) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+			flusher.Flush()
+		}
+	}
+}
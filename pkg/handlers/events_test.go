@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vatine/gochecker/pkg/events"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func TestHandleEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(HandleEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?prefix=example.com/code&status=build-failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The subscription is in place once the headers are sent.
+	events.Publish(events.Event{Type: events.JobQueued, Package: "example.com/code@v1.0.0"})
+	events.Publish(events.Event{
+		Type:    events.Report,
+		Package: "example.com/other@v1.0.0",
+		Data:    PackagePayload{Data: pkgdata.PackageStats{DownloadSucceeded: true}},
+	})
+	events.Publish(events.Event{
+		Type:    events.Report,
+		Package: "example.com/code@v1.0.0",
+		Data:    PackagePayload{Package: "example.com/code@v1.0.0", Data: pkgdata.PackageStats{DownloadSucceeded: true}},
+	})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "event: report" {
+			t.Errorf("First event, got %q", line)
+		}
+		data := <-lines
+		if !strings.Contains(data, `"package":"example.com/code@v1.0.0"`) {
+			t.Errorf("Event data, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+	}
+}
+
+func TestCloseEventStreams(t *testing.T) {
+	defer func() {
+		streamLock.Lock()
+		streamsDone = make(chan struct{})
+		streamLock.Unlock()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(HandleEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	closed := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		closed <- err
+	}()
+
+	CloseEventStreams()
+	CloseEventStreams()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Reading stream, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream still open after CloseEventStreams")
+	}
+}
+
+func TestEventMatches(t *testing.T) {
+	cases := []struct {
+		pkg    string
+		prefix string
+		want   bool
+	}{
+		{"example.com/code@v1.0.0", "", true},
+		{"example.com/code@v1.0.0", "example.com/code", true},
+		{"example.com/code/sub@v1.0.0", "example.com/code/", true},
+		{"example.com/code/sub@v1.0.0", "example.com/code", true},
+		{"example.com/code@v1.0.0", "example.com/code@v1.0.0", true},
+		{"example.com/codec@v1.0.0", "example.com/code", false},
+		{"example.com/code@v1.0.0", "example.com/co", false},
+		{"example.com/code@v1.0.0", "example.com/code@v1", false},
+	}
+
+	for ix, c := range cases {
+		e := events.Event{Type: events.JobQueued, Package: c.pkg}
+		if got := eventMatches(e, c.prefix, ""); got != c.want {
+			t.Errorf("Case #%d, %s with prefix %q, got %v, want %v", ix, c.pkg, c.prefix, got, c.want)
+		}
+	}
+}
@@ -7,16 +7,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/events"
+	"github.com/vatine/gochecker/pkg/logstore"
+	"github.com/vatine/gochecker/pkg/metrics"
 	"github.com/vatine/gochecker/pkg/pkgdata"
 	"github.com/vatine/gochecker/pkg/validation"
 )
 
 type PackagePayload struct {
-	Package string               `json:"package"`
-	Data    pkgdata.PackageStats `json:"data"`
+	Package   string               `json:"package"`
+	JobID     string               `json:"jobId,omitempty"`
+	Toolchain string               `json:"toolchain,omitempty"`
+	Data      pkgdata.PackageStats `json:"data"`
 }
 
 type ValidationRequest struct {
@@ -26,24 +33,95 @@ type ValidationRequest struct {
 
 var VC validation.ValidationConfiguration
 
+// The package data store that the handlers read from and write to.
+var Store pkgdata.Store
+
+// Where uploaded build and test logs are kept.
+var Logs *logstore.LogStore
+
+// How reports and admin requests are authenticated.
+var Auth auth.Config
+
+// Accept reports that carry no job ID, from builds started by hand.
+var AllowManualReports bool
+
+// Largest log we accept for upload.
+const maxLogSize = 16 * 1024 * 1024
+
+var reportsReceived = metrics.NewCounter("gochecker_reports_total", "Build report callbacks received, by outcome.", "outcome")
+var validationRequests = metrics.NewCounter("gochecker_validation_requests_total", "Validation requests from Athens, by outcome.", "outcome")
+var policyDenials = metrics.NewCounter("gochecker_policy_denials_total", "Validation requests the policy denied (or would deny, in dry-run mode), by rule.", "rule")
+
 // Update status for a module at a specific version.
 func HandleStatusCallback(w http.ResponseWriter, r *http.Request) {
 	var payload PackagePayload
+
+	worker, err := Auth.CheckReporter(r)
+	if err != nil {
+		reportsReceived.Inc("unauthorized")
+		auth.Deny(w, err)
+		return
+	}
+
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		reportsReceived.Inc("error")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	err = json.Unmarshal(b, &payload)
 	if err != nil {
+		reportsReceived.Inc("malformed")
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, err)
 		return
 	}
 
-	logrus.WithFields(logrus.Fields{"package": payload.Package}).Info("Status update")
+	err = Auth.CheckSignature(r, b, payload.JobID, payload.Package)
+	if err != nil {
+		reportsReceived.Inc("unauthorized")
+		logrus.WithFields(logrus.Fields{
+			"package": payload.Package,
+			"worker":  worker,
+		}).Warn("Report with bad signature")
+		auth.Deny(w, err)
+		return
+	}
+
+	if payload.JobID != "" || !AllowManualReports {
+		err = validation.CompleteJob(payload.JobID, payload.Package)
+		if err != nil {
+			reportsReceived.Inc("quarantined")
+			quarantine(payload, err.Error())
+			if err == validation.ErrDuplicateReport {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+			}
+			fmt.Fprintln(w, err)
+			return
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package": payload.Package,
+		"job":     payload.JobID,
+		"worker":  worker,
+	}).Info("Status update")
 
-	pkgdata.SetPackageData(payload.Package, payload.Data)
+	Store.AddRun(payload.Package, pkgdata.RunRecord{
+		Time:      time.Now(),
+		Image:     VC.Image,
+		Toolchain: payload.Toolchain,
+		Stats:     payload.Data,
+	})
+	noteReport(payload.Package, payload.Data)
+	reportsReceived.Inc("accepted")
+	events.Publish(events.Event{
+		Type:    events.Report,
+		Package: payload.Package,
+		Data:    payload,
+	})
 	logrus.WithFields(logrus.Fields{
 		"package": payload.Package,
 		"pkgdata": payload.Data,
@@ -52,6 +130,117 @@ func HandleStatusCallback(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Return all recorded runs for the package named in the "package"
+// query parameter, as JSON.
+func HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Unexpected method, %s.", r.Method)
+		return
+	}
+
+	name := r.URL.Query().Get("package")
+	history, ok := Store.History(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such package, %s", name)
+		return
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Upload (POST) or fetch (GET) build and test logs.
+//
+// A POST stores the request body and responds with the log ID, as
+// JSON. A GET with an "id" query parameter returns that log, and a GET
+// with a "package" query parameter returns the failures of the latest
+// run of that package, with their log IDs, as JSON.
+func HandleLogs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		if _, err := Auth.CheckReporter(r); err != nil {
+			auth.Deny(w, err)
+			return
+		}
+		uploadLog(w, r)
+	case "GET":
+		if id := r.URL.Query().Get("id"); id != "" {
+			fetchLog(w, id)
+			return
+		}
+		packageLogs(w, r.URL.Query().Get("package"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Unexpected method, %s.", r.Method)
+	}
+}
+
+func uploadLog(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLogSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	id, err := Logs.Put(b)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Storing log")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package": r.URL.Query().Get("package"),
+		"id":      id,
+	}).Debug("Log stored")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+func fetchLog(w http.ResponseWriter, id string) {
+	b, err := Logs.Get(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such log, %s", id)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+func packageLogs(w http.ResponseWriter, name string) {
+	stats, ok := Store.Get(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such package, %s", name)
+		return
+	}
+
+	failures := stats.Failures
+	if failures == nil {
+		failures = []pkgdata.Failure{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failures)
+}
+
 // Handle an incoming validation request from Athens
 func HandleValidation(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -82,21 +271,37 @@ func HandleValidation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pkg := pkgdata.BuildPackageName(vr.Module, vr.Version)
-	if !pkgdata.EnsurePackage(pkg) {
-		err := VC.Start(vr.Module, vr.Version)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, err)
+
+	decision := Policy.Decide(vr.Module, vr.Version)
+	if !decision.Allow {
+		logrus.WithFields(logrus.Fields{
+			"package": pkg,
+			"rule":    decision.Rule,
+			"reason":  decision.Reason,
+			"dry-run": Policy.DryRun,
+		}).Info("Policy denies module.")
+		policyDenials.Inc(decision.Rule)
+		if !Policy.DryRun {
+			validationRequests.Inc("denied")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "%s: %s\n", decision.Rule, decision.Reason)
 			return
 		}
 	}
+
+	if !Store.Ensure(pkg) {
+		VC.Start(vr.Module, vr.Version)
+		validationRequests.Inc("dispatched")
+	} else {
+		validationRequests.Inc("seen")
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 // Make sure we can trigger a save from the outside.
 func SaveHandler(w http.ResponseWriter, r *http.Request) {
 	logrus.Info("saving data")
-	err := pkgdata.Save()
+	err := Store.Save()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Eror saving, %v", err)
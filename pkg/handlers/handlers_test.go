@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+	"github.com/vatine/gochecker/pkg/validation"
+)
+
+// A runner that hands the job environment to the test, and runs until
+// released.
+type capturingRunner struct {
+	env     chan []string
+	release chan struct{}
+}
+
+func (r capturingRunner) Run(ctx context.Context, job *validation.Job, env []string) error {
+	r.env <- env
+	<-r.release
+	return nil
+}
+
+// Return the value of name in env, as NAME=value.
+func envValue(env []string, name string) string {
+	for _, v := range env {
+		if strings.HasPrefix(v, name+"=") {
+			return strings.TrimPrefix(v, name+"=")
+		}
+	}
+	return ""
+}
+
+func TestHandleStatusCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SetQuarantine(filepath.Join(dir, "quarantine")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		quarantineLock.Lock()
+		quarantineFile.Close()
+		quarantineFile = nil
+		quarantineLock.Unlock()
+	}()
+
+	store := pkgdata.NewMemoryStore()
+	Store = store
+	Auth = auth.Config{ReportTokens: map[string]string{"builder": "token"}, SigningKey: "secret"}
+	defer func() { Auth = auth.Config{} }()
+
+	r := capturingRunner{make(chan []string), make(chan struct{})}
+	VC = validation.ValidationConfiguration{Runner: r, SigningKey: "secret"}
+	defer func() { VC = validation.ValidationConfiguration{} }()
+	VC.StartWorkers(1)
+	defer validation.SetWorkers(0)
+	defer close(r.release)
+
+	VC.Start("example.com/code", "v1.0.0")
+	var env []string
+	select {
+	case env = <-r.env:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job never started")
+	}
+	jobID := envValue(env, "GOCHECKER_JOB_ID")
+	jobKey := envValue(env, "GOCHECKER_JOB_KEY")
+
+	cases := []struct {
+		name   string
+		token  string
+		pkg    string
+		jobID  string
+		key    string
+		code   int
+		stored bool
+	}{
+		{"no token", "", "example.com/code@v1.0.0", jobID, jobKey, http.StatusUnauthorized, false},
+		{"bad token", "bogus", "example.com/code@v1.0.0", jobID, jobKey, http.StatusForbidden, false},
+		{"bad signature", "token", "example.com/code@v1.0.0", jobID, "bogus", http.StatusForbidden, false},
+		{"key for another job", "token", "example.com/code@v1.0.0", jobID, auth.JobKey("secret", "earlier-job", "example.com/code@v1.0.0"), http.StatusForbidden, false},
+		{"unknown job", "token", "example.com/code@v1.0.0", "no-such-job", auth.JobKey("secret", "no-such-job", "example.com/code@v1.0.0"), http.StatusUnprocessableEntity, false},
+		{"mismatched job", "token", "example.com/code@v1.1.0", jobID, auth.JobKey("secret", jobID, "example.com/code@v1.1.0"), http.StatusUnprocessableEntity, false},
+		{"accepted", "token", "example.com/code@v1.0.0", jobID, jobKey, http.StatusOK, true},
+		{"duplicate", "token", "example.com/code@v1.0.0", jobID, jobKey, http.StatusConflict, true},
+	}
+
+	for _, c := range cases {
+		b, _ := json.Marshal(PackagePayload{
+			Package: c.pkg,
+			JobID:   c.jobID,
+			Data:    pkgdata.PackageStats{DownloadSucceeded: true},
+		})
+		req := httptest.NewRequest("POST", "/api/report", bytes.NewReader(b))
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		req.Header.Set(auth.SignatureHeader, auth.Sign(c.key, b))
+		w := httptest.NewRecorder()
+		HandleStatusCallback(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s, got status %d, want %d", c.name, w.Code, c.code)
+		}
+		if _, ok := store.Get(c.pkg); ok != c.stored {
+			t.Errorf("%s, got stored %v, want %v", c.name, ok, c.stored)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var q quarantined
+		if err := json.Unmarshal(line, &q); err != nil {
+			t.Fatal(err)
+		}
+		reasons = append(reasons, q.Reason)
+	}
+	want := []string{
+		validation.ErrUnknownJob.Error(),
+		validation.ErrJobMismatch.Error(),
+		validation.ErrDuplicateReport.Error(),
+	}
+	if strings.Join(reasons, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Quarantined, got %q, want %q", reasons, want)
+	}
+}
@@ -0,0 +1,216 @@
+package handlers
+
+// A policy layer for validation requests, deciding which module
+// versions Athens should be allowed to serve.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vatine/gochecker/pkg/deciders"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+// A single policy rule. Check returns a reason if the rule denies the
+// module version, and an empty string otherwise.
+type Rule interface {
+	Name() string
+	Check(module, version string) string
+}
+
+// The outcome of a policy check. Rule and Reason are only set when
+// the module version was denied.
+type Decision struct {
+	Allow  bool
+	Rule   string
+	Reason string
+}
+
+// Policy configuration, as read from a policy file.
+type PolicyConfig struct {
+	// Only log what would be denied, allow everything.
+	DryRun bool `json:"dryRun"`
+	// Names of deciders (from pkg/deciders) to deny on, out of
+	// "banned", "domain-only" and "incommensurate".
+	Deciders []string `json:"deciders,omitempty"`
+	// Deny modules with these path prefixes.
+	DenyPrefixes []string `json:"denyPrefixes,omitempty"`
+	// If set, deny modules that do not have one of these prefixes.
+	AllowPrefixes []string `json:"allowPrefixes,omitempty"`
+	// Deny module versions we have already failed to download.
+	DenyFailedDownloads bool `json:"denyFailedDownloads,omitempty"`
+	// Module versions (module@version) to deny, as a manual deny
+	// list. The retract directives in go.mod files are not
+	// consulted.
+	Retracted []string `json:"retracted,omitempty"`
+}
+
+// An ordered set of rules; the first rule to deny decides.
+type ValidationPolicy struct {
+	DryRun bool
+	Rules  []Rule
+}
+
+// The policy validation requests are checked against, nil to allow
+// everything.
+var Policy *ValidationPolicy
+
+// Load a policy configuration from a JSON file.
+func LoadPolicyConfig(path string) (PolicyConfig, error) {
+	var rv PolicyConfig
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rv, err
+	}
+
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
+
+var deciderFuncs = map[string]func(pkgdata.Package) bool{
+	"banned":         deciders.Banned,
+	"domain-only":    deciders.DomainOnly,
+	"incommensurate": deciders.IncommensurateName,
+}
+
+// Build a policy from a configuration. Rules that consult previous
+// results use store.
+func NewPolicy(c PolicyConfig, store pkgdata.Store) (*ValidationPolicy, error) {
+	rv := &ValidationPolicy{DryRun: c.DryRun}
+
+	for _, name := range c.Deciders {
+		f, ok := deciderFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown decider, %s", name)
+		}
+		rv.Rules = append(rv.Rules, deciderRule{name, f})
+	}
+	if len(c.DenyPrefixes) > 0 {
+		rv.Rules = append(rv.Rules, denyPrefixRule(c.DenyPrefixes))
+	}
+	if len(c.AllowPrefixes) > 0 {
+		rv.Rules = append(rv.Rules, allowPrefixRule(c.AllowPrefixes))
+	}
+	if c.DenyFailedDownloads {
+		rv.Rules = append(rv.Rules, failedDownloadRule{store})
+	}
+	if len(c.Retracted) > 0 {
+		retracted := make(retractedRule)
+		for _, pkg := range c.Retracted {
+			retracted[pkg] = true
+		}
+		rv.Rules = append(rv.Rules, retracted)
+	}
+
+	return rv, nil
+}
+
+// Check a module version against all rules.
+func (p *ValidationPolicy) Decide(module, version string) Decision {
+	if p == nil {
+		return Decision{Allow: true}
+	}
+
+	for _, rule := range p.Rules {
+		if reason := rule.Check(module, version); reason != "" {
+			return Decision{Allow: false, Rule: rule.Name(), Reason: reason}
+		}
+	}
+
+	return Decision{Allow: true}
+}
+
+// Deny anything one of the deciders flags.
+type deciderRule struct {
+	name string
+	f    func(pkgdata.Package) bool
+}
+
+func (r deciderRule) Name() string {
+	return r.name
+}
+
+func (r deciderRule) Check(module, version string) string {
+	if r.f(pkgdata.Package{Name: pkgdata.BuildPackageName(module, version)}) {
+		return "flagged by decider"
+	}
+	return ""
+}
+
+// Return true if module is, or is below, one of the prefixes.
+func matchesPrefix(module string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if module == prefix || strings.HasPrefix(module, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type denyPrefixRule []string
+
+func (r denyPrefixRule) Name() string {
+	return "deny-prefix"
+}
+
+func (r denyPrefixRule) Check(module, version string) string {
+	if matchesPrefix(module, r) {
+		return "module on deny list"
+	}
+	return ""
+}
+
+type allowPrefixRule []string
+
+func (r allowPrefixRule) Name() string {
+	return "allow-prefix"
+}
+
+func (r allowPrefixRule) Check(module, version string) string {
+	if !matchesPrefix(module, r) {
+		return "module not on allow list"
+	}
+	return ""
+}
+
+// Deny module versions that have been tried, and failed to download.
+// A package we have seen but have no runs for is still pending, and
+// is not denied.
+type failedDownloadRule struct {
+	store pkgdata.Store
+}
+
+func (r failedDownloadRule) Name() string {
+	return "failed-download"
+}
+
+func (r failedDownloadRule) Check(module, version string) string {
+	runs, ok := r.store.History(pkgdata.BuildPackageName(module, version))
+	if !ok || len(runs) == 0 {
+		return ""
+	}
+	// Runs that ended without a report say nothing about the module.
+	latest := runs[len(runs)-1].Stats
+	if latest.Outcome == "" && !latest.DownloadSucceeded {
+		return "previously failed to download"
+	}
+	return ""
+}
+
+// Deny the module versions listed in the policy. This is a list kept
+// by hand, not read from retract directives.
+type retractedRule map[string]bool
+
+func (r retractedRule) Name() string {
+	return "retracted"
+}
+
+func (r retractedRule) Check(module, version string) string {
+	if r[pkgdata.BuildPackageName(module, version)] {
+		return "version is retracted"
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	c := PolicyConfig{
+		Deciders:            []string{"banned", "domain-only"},
+		DenyPrefixes:        []string{"example.com/other"},
+		AllowPrefixes:       []string{"example.com", "github.com"},
+		DenyFailedDownloads: true,
+		Retracted:           []string{"example.com/code@v1.2.0"},
+	}
+	p, err := NewPolicy(c, fakeStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		module  string
+		version string
+		rule    string
+	}{
+		{"example.com/code", "v1.1.0", ""},
+		{"example.com/new", "v1.0.0", ""},
+		{"github.com/someone", "v1.0.0", "banned"},
+		{"example.com", "v1.0.0", "domain-only"},
+		{"example.com/other", "v1.0.0", "deny-prefix"},
+		{"example.com/other/sub", "v1.0.0", "deny-prefix"},
+		{"example.com/otherness", "v1.0.0", ""},
+		{"gitlab.com/someone/code", "v1.0.0", "allow-prefix"},
+		{"example.com/code", "v1.0.0", "failed-download"},
+		{"example.com/code", "v1.2.0", "retracted"},
+	}
+
+	for ix, c := range cases {
+		d := p.Decide(c.module, c.version)
+		if d.Allow != (c.rule == "") || d.Rule != c.rule {
+			t.Errorf("Case #%d, %s@%s, got %v, want rule %q", ix, c.module, c.version, d, c.rule)
+		}
+	}
+
+	_, err = NewPolicy(PolicyConfig{Deciders: []string{"bogus"}}, fakeStore())
+	if err == nil {
+		t.Errorf("Expected an error for an unknown decider")
+	}
+}
+
+func TestValidationDenied(t *testing.T) {
+	Store = fakeStore()
+	defer func() { Policy = nil }()
+
+	for _, dryRun := range []bool{false, true} {
+		Policy = &ValidationPolicy{DryRun: dryRun, Rules: []Rule{retractedRule{"example.com/code@v1.2.0": true}}}
+
+		r := httptest.NewRequest("POST", "/api/validate", strings.NewReader(`{"Module": "example.com/code", "Version": "v1.2.0"}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		HandleValidation(w, r)
+
+		want := http.StatusForbidden
+		if dryRun {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("Dry run %v, got status %d, want %d", dryRun, w.Code, want)
+		}
+	}
+}
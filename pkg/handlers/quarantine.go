@@ -0,0 +1,67 @@
+package handlers
+
+// Reports we did not accept are kept in a quarantine file, so they
+// can be looked at (and, if need be, replayed) later.
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type quarantined struct {
+	Time    time.Time      `json:"time"`
+	Reason  string         `json:"reason"`
+	Payload PackagePayload `json:"payload"`
+}
+
+var quarantineLock sync.Mutex
+var quarantineFile *os.File
+
+// Open (creating if needed) the file quarantined reports are appended
+// to.
+func SetQuarantine(path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+
+	if quarantineFile != nil {
+		quarantineFile.Close()
+	}
+	quarantineFile = out
+
+	return nil
+}
+
+// Keep a report we are not accepting, with the reason why.
+func quarantine(payload PackagePayload, reason string) {
+	logrus.WithFields(logrus.Fields{
+		"package": payload.Package,
+		"job":     payload.JobID,
+		"reason":  reason,
+	}).Warn("Quarantining report")
+
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+
+	if quarantineFile == nil {
+		return
+	}
+
+	b, err := json.Marshal(quarantined{time.Now(), reason, payload})
+	if err == nil {
+		_, err = quarantineFile.Write(append(b, '\n'))
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Writing quarantine")
+	}
+}
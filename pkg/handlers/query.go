@@ -0,0 +1,205 @@
+package handlers
+
+// Read-only endpoints for looking at collected package results.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+// Default and maximum page size for package listings.
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// A single package in a query response.
+type PackageResult struct {
+	Name  string               `json:"name"`
+	Stats pkgdata.PackageStats `json:"stats"`
+}
+
+// A page of packages in a query response.
+type PackageList struct {
+	Total    int             `json:"total"`
+	Offset   int             `json:"offset"`
+	Limit    int             `json:"limit"`
+	Packages []PackageResult `json:"packages"`
+}
+
+// The status filter for packages that have no runs yet, because
+// their job is still queued or running. Nothing else matches them.
+const statusPending = "pending"
+
+// Status filters for package listings, mapped to the field that has
+// to have failed, or the outcome of runs that ended without a report.
+// Anything but download failures and outcomes also requires that the
+// download succeeded.
+var statusFilters = map[string]string{
+	statusPending:     statusPending,
+	"download-failed": pkgdata.FieldDownload,
+	"build-failed":    pkgdata.FieldBuild,
+	"tests-failed":    pkgdata.FieldTest,
+	"vet-failed":      pkgdata.FieldVet,
+	"fmt-failed":      pkgdata.FieldFmt,
+	"timed-out":       pkgdata.OutcomeTimedOut,
+	"infra-failed":    pkgdata.OutcomeInfraFailure,
+}
+
+// Return true if a package matches a status filter.
+func matchesStatus(pkg pkgdata.Package, status string) bool {
+	if status == "" {
+		return true
+	}
+	if pkg.Pending || status == statusPending {
+		return pkg.Pending && status == statusPending
+	}
+
+	stats := pkg.Stats
+	field := statusFilters[status]
+	switch {
+	case field == pkgdata.OutcomeTimedOut || field == pkgdata.OutcomeInfraFailure:
+		return stats.Outcome == field
+	case stats.Outcome != "":
+		return false
+	case field == pkgdata.FieldDownload:
+		return !stats.DownloadSucceeded
+	}
+
+	return stats.DownloadSucceeded && !stats.Passed(field)
+}
+
+// Write v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Return true if the request is a GET, otherwise respond with an
+// error and return false.
+func requireGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Unexpected method, %s.", r.Method)
+		return false
+	}
+	return true
+}
+
+// Return the latest stats for the package named in the "name" query
+// parameter (module@version), as JSON.
+func HandlePackage(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	stats, ok := Store.Get(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such package, %s", name)
+		return
+	}
+
+	writeJSON(w, PackageResult{name, stats})
+}
+
+// Return all versions we have of the module named in the "module"
+// query parameter, with their latest stats, as JSON.
+func HandleModule(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Missing module")
+		return
+	}
+
+	rv := []PackageResult{}
+	for pkg := range Store.Iterate(r.Context()) {
+		if strings.HasPrefix(pkg.Name, module+"@") {
+			rv = append(rv, PackageResult{pkg.Name, pkg.Stats})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Name < rv[j].Name
+	})
+
+	writeJSON(w, rv)
+}
+
+// Return a page of packages, sorted by name, as JSON. The "status"
+// query parameter filters on one of pending, download-failed,
+// build-failed, tests-failed, vet-failed, fmt-failed, timed-out or
+// infra-failed, and "offset" and "limit" select the page.
+func HandlePackages(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	status := q.Get("status")
+	if _, ok := statusFilters[status]; status != "" && !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown status, %s", status)
+		return
+	}
+
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad offset, %s", q.Get("offset"))
+		return
+	}
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil || limit < 1 || limit > maxLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad limit, %s", q.Get("limit"))
+		return
+	}
+
+	rv := PackageList{Offset: offset, Limit: limit, Packages: []PackageResult{}}
+	var matches []PackageResult
+	for pkg := range Store.Iterate(r.Context()) {
+		if matchesStatus(pkg, status) {
+			matches = append(matches, PackageResult{pkg.Name, pkg.Stats})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Name < matches[j].Name
+	})
+
+	rv.Total = len(matches)
+	if offset < len(matches) {
+		end := offset + limit
+		if end > len(matches) {
+			end = len(matches)
+		}
+		rv.Packages = matches[offset:end]
+	}
+
+	writeJSON(w, rv)
+}
+
+// Parse an integer query parameter, returning def if it is empty.
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
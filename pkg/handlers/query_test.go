@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func fakeStore() pkgdata.Store {
+	s := pkgdata.NewMemoryStore()
+	s.Set("example.com/code@v1.0.0", pkgdata.PackageStats{})
+	s.Set("example.com/code@v1.1.0", pkgdata.PackageStats{DownloadSucceeded: true, AllBuildsPass: false})
+	s.Set("example.com/code@v1.2.0", pkgdata.PackageStats{DownloadSucceeded: true, AllBuildsPass: true, AllTestsPassed: true})
+	s.Set("example.com/other@v1.0.0", pkgdata.PackageStats{DownloadSucceeded: true, AllBuildsPass: false})
+	s.Ensure("example.com/other@v1.1.0")
+	return s
+}
+
+func TestHandlePackages(t *testing.T) {
+	Store = fakeStore()
+
+	cases := []struct {
+		query string
+		code  int
+		total int
+		count int
+	}{
+		{"", http.StatusOK, 5, 5},
+		{"?status=pending", http.StatusOK, 1, 1},
+		{"?status=download-failed", http.StatusOK, 1, 1},
+		{"?status=build-failed", http.StatusOK, 2, 2},
+		{"?status=build-failed&limit=1", http.StatusOK, 2, 1},
+		{"?status=build-failed&offset=5", http.StatusOK, 2, 0},
+		{"?status=bogus", http.StatusBadRequest, 0, 0},
+		{"?limit=0", http.StatusBadRequest, 0, 0},
+	}
+
+	for ix, c := range cases {
+		w := httptest.NewRecorder()
+		HandlePackages(w, httptest.NewRequest("GET", "/api/packages"+c.query, nil))
+		if w.Code != c.code {
+			t.Errorf("Case #%d, got status %d, want %d", ix, w.Code, c.code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		var got PackageList
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Case #%d, %v", ix, err)
+		}
+		if got.Total != c.total || len(got.Packages) != c.count {
+			t.Errorf("Case #%d, got total %d and %d packages, want %d and %d", ix, got.Total, len(got.Packages), c.total, c.count)
+		}
+	}
+}
+
+func TestHandleModule(t *testing.T) {
+	Store = fakeStore()
+
+	w := httptest.NewRecorder()
+	HandleModule(w, httptest.NewRequest("GET", "/api/module?module=example.com/code", nil))
+
+	var got []PackageResult
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Name != "example.com/code@v1.0.0" {
+		t.Errorf("Module versions, got %v", got)
+	}
+}
+
+func TestHandleDashboard(t *testing.T) {
+	Store = fakeStore()
+	noteReport("example.com/code@v1.2.0", pkgdata.PackageStats{DownloadSucceeded: true})
+
+	w := httptest.NewRecorder()
+	HandleDashboard(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Dashboard, got status %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "example.com/code@v1.2.0") {
+		t.Errorf("Dashboard does not show recent report")
+	}
+}
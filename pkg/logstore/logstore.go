@@ -0,0 +1,126 @@
+// Package for keeping build and test logs. Logs are stored
+// compressed, under the SHA-256 of their contents, so the same output
+// reported many times is only stored once.
+package logstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const idPrefix = "sha256:"
+
+type LogStore struct {
+	dir string
+}
+
+// Return a LogStore keeping its logs in the "logs" subdirectory of
+// dataDir, creating it if needed.
+func New(dataDir string) (*LogStore, error) {
+	dir := filepath.Join(dataDir, "logs")
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogStore{dir: dir}, nil
+}
+
+// Return the ID a log with the given contents is stored under.
+func ID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return idPrefix + hex.EncodeToString(sum[:])
+}
+
+// Return the path a log is stored at, or an error if the ID is
+// malformed.
+func (l *LogStore) path(id string) (string, error) {
+	sum := strings.TrimPrefix(id, idPrefix)
+	_, err := hex.DecodeString(sum)
+	if err != nil || len(sum) != 2*sha256.Size || sum == id {
+		return "", fmt.Errorf("Malformed log ID, %s", id)
+	}
+
+	return filepath.Join(l.dir, sum[:2], sum+".gz"), nil
+}
+
+// Store a log, returning its ID. Storing a log we already have is
+// cheap, and does not write anything.
+func (l *LogStore) Put(data []byte) (string, error) {
+	id := ID(data)
+	target, err := l.path(id)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		return id, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(data)
+	if err != nil {
+		return "", err
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first, so a log is never seen
+	// half-written.
+	out, err := ioutil.TempFile(filepath.Dir(target), ".log-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = out.Write(buf.Bytes())
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), target)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Return the contents of a stored log.
+func (l *LogStore) Get(id string) ([]byte, error) {
+	source, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return ioutil.ReadAll(zr)
+}
@@ -0,0 +1,53 @@
+package logstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("./main.go:3:8: undefined: foo\n")
+	id, err := l.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := l.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != again {
+		t.Errorf("Same data, got IDs %s and %s", id, again)
+	}
+
+	stored, _ := filepath.Glob(filepath.Join(dir, "logs", "*", "*.gz"))
+	if len(stored) != 1 {
+		t.Errorf("Stored files, got %d, want 1", len(stored))
+	}
+
+	got, err := l.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("Get, got %q, want %q", got, data)
+	}
+
+	for _, bad := range []string{"", "sha256:", "sha256:../../etc/passwd", id[len(idPrefix):]} {
+		if _, err := l.Get(bad); err == nil {
+			t.Errorf("Get(%q), got no error", bad)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package for exporting metrics in the Prometheus text exposition
+// format. This only does the small subset we need: counters and
+// gauges, optionally with labels.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(w *strings.Builder)
+}
+
+var registryLock sync.Mutex
+var registry = make(map[string]metric)
+
+func register(name string, m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry[name] = m
+}
+
+// A set of values, one per combination of label values.
+type vector struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newVector(kind, name, help string, labels []string) *vector {
+	v := &vector{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		v.values[""] = 0.0
+	}
+	register(name, v)
+	return v
+}
+
+// Turn label values into the label part of a sample line.
+func (v *vector) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for ix, label := range v.labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[ix])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, label, value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (v *vector) add(delta float64, values []string) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] += delta
+}
+
+func (v *vector) set(value float64, values []string) {
+	key := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] = value
+}
+
+func (v *vector) write(w *strings.Builder) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	var keys []string
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", v.name, key, v.values[key])
+	}
+}
+
+// A monotonically increasing count.
+type Counter struct {
+	v *vector
+}
+
+// Create and register a counter, with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVector("counter", name, help, labels)}
+}
+
+// Add one to the counter with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.v.add(1.0, values)
+}
+
+// Add delta (which should not be negative) to the counter with the
+// given label values.
+func (c *Counter) Add(delta float64, values ...string) {
+	c.v.add(delta, values)
+}
+
+// A value that can go up and down.
+type Gauge struct {
+	v *vector
+}
+
+// Create and register a gauge, with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newVector("gauge", name, help, labels)}
+}
+
+// Set the gauge with the given label values.
+func (g *Gauge) Set(value float64, values ...string) {
+	g.v.set(value, values)
+}
+
+// A gauge whose value is read from a function at scrape time.
+type gaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// Create and register an unlabelled gauge, whose value is returned
+// by f when scraped.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(name, &gaugeFunc{name, help, f})
+}
+
+func (g *gaugeFunc) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %v\n", g.name, g.f())
+}
+
+// Write all registered metrics, in the text exposition format.
+func Write(w *strings.Builder) {
+	registryLock.Lock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for ix, name := range names {
+		metrics[ix] = registry[name]
+	}
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Serve all registered metrics.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	Write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
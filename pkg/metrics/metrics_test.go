@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "outcome")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Inc(`bad "quoted"`)
+	g := NewGauge("test_depth", "Depth.")
+	g.Set(3)
+	NewGaugeFunc("test_workers", "Workers.", func() float64 { return 5 })
+
+	var b strings.Builder
+	Write(&b)
+	got := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		"test_requests_total{outcome=\"ok\"} 2\n",
+		"test_requests_total{outcome=\"bad \\\"quoted\\\"\"} 1\n",
+		"# TYPE test_depth gauge\ntest_depth 3\n",
+		"test_workers 5\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Output missing %q, got:\n%s", want, got)
+		}
+	}
+}
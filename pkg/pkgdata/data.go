@@ -4,287 +4,178 @@
 package pkgdata
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	// "sort"
-	"sync"
+	"reflect"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 // Various bits of data about a package/module.
 type PackageStats struct {
-	DownloadSucceeded bool     `json:"downloadSucceeded"`
-	BuildableTargets  int      `json:"buildableTargets"`
-	AllBuildsPass     bool     `json:"allBuildsPass"`
-	TestableTargets   int      `json:"testableTargets"`
-	AllTestsPassed    bool     `json:"allTestsPass"`
-	VetPassed         []string `json:"passedVets,omitempty"`
-	FailedBuilds      []string `json:"failedBuilds,omitempty"`
-	FailedTests       []string `json:"failedTests,omitempty"`
-	FailedVets        []string `json:"failedVets,omitempty"`
-	FailedFmt         []string `json:"failedFmt,omitempty"`
+	DownloadSucceeded bool      `json:"downloadSucceeded"`
+	BuildableTargets  int       `json:"buildableTargets"`
+	AllBuildsPass     bool      `json:"allBuildsPass"`
+	TestableTargets   int       `json:"testableTargets"`
+	AllTestsPassed    bool      `json:"allTestsPass"`
+	VetPassed         []string  `json:"passedVets,omitempty"`
+	FailedBuilds      []string  `json:"failedBuilds,omitempty"`
+	FailedTests       []string  `json:"failedTests,omitempty"`
+	FailedVets        []string  `json:"failedVets,omitempty"`
+	FailedFmt         []string  `json:"failedFmt,omitempty"`
+	Failures          []Failure `json:"failures,omitempty"`
+	// Set when the run ended without a report from the builder.
+	Outcome string `json:"outcome,omitempty"`
 }
 
-// A datatype suitable for iterating on the collected data
-type Package struct {
-	Name  string
-	Stats PackageStats
-}
+// Outcomes of runs that ended without a report from the builder.
+const (
+	// The build took longer than the job timeout, and was killed.
+	OutcomeTimedOut = "timed-out"
+	// The build never reported, even after retries, most likely
+	// because of a problem with the build infrastructure rather
+	// than with the module.
+	OutcomeInfraFailure = "infrastructure-failure"
+)
 
-var storagePath string
-var dataLock sync.Mutex
-var packages map[string]*PackageStats
-var clean bool
-var cleaned []string
+// The stages a target can fail in.
+const (
+	StageBuild = "build"
+	StageTest  = "test"
+	StageVet   = "vet"
+)
 
-func init() {
-	packages = make(map[string]*PackageStats)
-	clean = true
-}
+// Categories of failure, as classified by the builder from the
+// output of the failing command.
+const (
+	CauseMissingDependency = "missing-dependency"
+	CauseBuildConstraints  = "build-constraints"
+	CauseCgo               = "cgo-toolchain"
+	CauseTypeError         = "type-error"
+	CauseImportCycle       = "import-cycle"
+	CauseTestTimeout       = "test-timeout"
+	CausePanic             = "panic"
+	CauseNetwork           = "network-access"
+	CauseTestFailure       = "test-failure"
+	CauseVetFinding        = "vet-finding"
+	CauseUnknown           = "unknown"
+)
 
-// Turn a module, version pair into a package name for storage
-func BuildPackageName(module, version string) string {
-	return fmt.Sprintf("%s@%s", module, version)
+// All failure categories, in the order they are reported.
+var FailureCauses = []string{
+	CauseMissingDependency,
+	CauseBuildConstraints,
+	CauseCgo,
+	CauseTypeError,
+	CauseImportCycle,
+	CauseTestTimeout,
+	CausePanic,
+	CauseNetwork,
+	CauseTestFailure,
+	CauseVetFinding,
+	CauseUnknown,
 }
 
-// Set the directory where state files are kept.
-func SetStoragePath(newPath string) error {
-	info, err := os.Stat(newPath)
-	if err != nil {
-		return err
-	}
-
-	if !info.Mode().IsDir() {
-		return fmt.Errorf("Not a directory, %s", newPath)
-	}
-
-	storagePath = newPath
-	clean = true
-
-	return nil
+// Why a single target failed in a single stage. Log is the ID of the
+// command output in the log store, if it was uploaded.
+type Failure struct {
+	Target string `json:"target"`
+	Stage  string `json:"stage"`
+	Cause  string `json:"cause"`
+	Log    string `json:"log,omitempty"`
 }
 
-// Save package state to disk if there's been any changes since last
-// save. Mark the data as "clean".
-func Save() error {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	if clean {
-		return nil
-	}
-
-	filename := fmt.Sprintf("pkgdata-%s", time.Now().Format(time.RFC3339))
-	target := filepath.Join(storagePath, filename)
-
-	out, err := os.Create(target)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	b, err := json.Marshal(packages)
-	if err != nil {
-		return err
-	}
-
-	_, err = out.Write(b)
-
-	if err != nil {
-		return err
-	}
-	clean = true
-
-	return nil
-}
-
-// Load package state from disk.
-func Load(name string) error {
-
-	var intermediate map[string]PackageStats
-
-	source, err := os.Open(name)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"filename": name,
-			"error":    err,
-		}).Error("Opening file")
-		return err
-	}
-	defer source.Close()
-
-	b, err := ioutil.ReadAll(source)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(b, &intermediate)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Error("Failed to unmarshal save file.")
-		return err
-	}
-
-	for key, val := range intermediate {
-		EnsurePackage(key)
-		SetPackageData(key, val)
-	}
-
-	dataLock.Lock()
-	defer dataLock.Unlock()
-	clean = true
-
-	logrus.WithFields(logrus.Fields{"name": name}).Info("Loading complete.")
-
-	return nil
+// A datatype suitable for iterating on the collected data
+type Package struct {
+	Name  string
+	Stats PackageStats
+	// Set if no run has been recorded yet, because the package's
+	// job is still queued or running.
+	Pending bool
 }
 
-// Load the latest file from disk
-func LoadLatest() error {
-	pattern := filepath.Join(storagePath, "pkgdata-*")
-	names, err := filepath.Glob(pattern)
-	logrus.WithFields(logrus.Fields{
-		"pattern": pattern,
-		"names":   names,
-	}).Debug("Loading latest.")
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"pattern": pattern,
-			"error":   err,
-		}).Error("Globbing for latest.")
-		return err
-	}
-
-	if len(names) == 0 {
-		logrus.Info("No save files.")
-		return nil
-	}
-
-	name := names[len(names)-1]
-	logrus.WithFields(logrus.Fields{
-		"name": name,
-	}).Debug("About to load data.")
-	err = Load(name)
-
-	return err
+// The outcome of a single build run of a package.
+type RunRecord struct {
+	Time      time.Time    `json:"time"`
+	Image     string       `json:"image,omitempty"`
+	Toolchain string       `json:"toolchain,omitempty"`
+	Stats     PackageStats `json:"stats"`
 }
 
-// Check if we have seen any data for the named package.
-func PackageSeen(name string) bool {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	_, ok := packages[name]
-	return ok
+// Everything we know about a single package. The embedded
+// PackageStats is the latest run, so stored data stays readable by
+// anything that only cares about that. Data saved before we kept
+// history is given a single run when it is loaded (see
+// migrateHistory), so a record with an empty History is pending.
+type packageRecord struct {
+	PackageStats
+	History []RunRecord `json:"history,omitempty"`
 }
 
-// Return a copy of the package data for a given package
-func GetPackageData(name string) (PackageStats, bool) {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	rv, ok := packages[name]
-
-	if ok {
-		return *rv, true
-	}
-	return PackageStats{}, false
+// Return true if nothing has been recorded in the stats, as for a
+// package that has only been Ensured.
+func (s PackageStats) empty() bool {
+	return reflect.DeepEqual(s, PackageStats{})
 }
 
-// If we don't have any data about a given package, initialize an
-// empty PackageStats struct and store that. Return false if the
-// package didn't exist, otherwise return true.
-func EnsurePackage(name string) bool {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	_, ok := packages[name]
-	if !ok {
-		packages[name] = new(PackageStats)
-		clean = false
-		return false
-	}
-
-	return true
+// A Store holds the package data for one dataset. All methods are
+// expected to be safe for concurrent use, unless otherwise noted.
+type Store interface {
+	// If we don't have any data about a given package, initialize
+	// an empty PackageStats and store that. Return false if the
+	// package didn't exist, otherwise return true.
+	Ensure(name string) bool
+	// Return a copy of the package data for a given package.
+	Get(name string) (PackageStats, bool)
+	// Return all recorded runs for a given package, oldest first.
+	History(name string) ([]RunRecord, bool)
+	// Record a run with the given package stats, with no details
+	// about the builder.
+	Set(name string, data PackageStats)
+	// Record a run for a given package, making it the latest.
+	AddRun(name string, run RunRecord)
+	// Replace all recorded runs for a given package, the last run
+	// becoming the latest.
+	SetHistory(name string, runs []RunRecord)
+	// Delete a specific package from the store.
+	Purge(name string)
+	// Returns a channel on which all packages with their latest
+	// statistics will be passed, as they were when the iteration
+	// started. Cancelling ctx ends the iteration early.
+	Iterate(ctx context.Context) <-chan Package
+	// Persist the package data, if there's been any changes since
+	// the last save.
+	Save() error
+	// Load package data from the named source, merging it with
+	// what is already in the store.
+	Load(name string) error
 }
 
-// Set the package stats for a given package. This will set the state
-// to "not clean", even if we end up setting the exact same data that
-// we already had.
-func SetPackageData(name string, data PackageStats) {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	clean = false
-	blob, ok := packages[name]
-	if !ok {
-		packages[name] = new(PackageStats)
-	}
-
-	blob.DownloadSucceeded = data.DownloadSucceeded
-	blob.BuildableTargets = data.BuildableTargets
-	blob.AllBuildsPass = data.AllBuildsPass
-	blob.TestableTargets = data.TestableTargets
-	blob.AllTestsPassed = data.AllTestsPassed
-	blob.VetPassed = data.VetPassed
-	blob.FailedBuilds = data.FailedBuilds
-	blob.FailedTests = data.FailedTests
-	blob.FailedVets = data.FailedVets
+// Turn a module, version pair into a package name for storage
+func BuildPackageName(module, version string) string {
+	return fmt.Sprintf("%s@%s", module, version)
 }
 
-// Returns a channel on which all packages with statistics will be
-// passed.  This function is NOT concurrency-safe, as it does not lock
-// the data.  But for "off-line" use (gathering and emitting
-// statistics) this is not a concern.
-func AllPackages() chan Package {
-	rv := make(chan Package)
-
-	go func() {
-		for pkg, stats := range packages {
-			rv <- Package{pkg, *stats}
-		}
-		close(rv)
-	}()
-
-	return rv
+// Check if we have seen any data for the named package.
+func PackageSeen(s Store, name string) bool {
+	_, ok := s.Get(name)
+	return ok
 }
 
 // Drop all "download failed" packages from the statistics, to allow
 // for a clean(er) "stop everything, restart" experience.
 // Returns the number of packages deleted.
-func PurgeDownloadFailed() int {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	clean = false
-
+func PurgeDownloadFailed(s Store) int {
 	var toDelete []string
 
-	for key, val := range packages {
-		if !val.DownloadSucceeded {
-			toDelete = append(toDelete, key)
+	for pkg := range s.Iterate(context.Background()) {
+		if !pkg.Stats.DownloadSucceeded {
+			toDelete = append(toDelete, pkg.Name)
 		}
 	}
 
 	for _, key := range toDelete {
-		delete(packages, key)
+		s.Purge(key)
 	}
 
 	return len(toDelete)
 }
-
-// Delete a specific package from the statistics
-func PurgePackage(name string) {
-	dataLock.Lock()
-	defer dataLock.Unlock()
-
-	clean = false
-
-	delete(packages, name)
-}
@@ -0,0 +1,186 @@
+package pkgdata
+
+// Compute differences between two datasets, typically two crawls.
+
+import (
+	"context"
+	"sort"
+)
+
+// The aspects of a package that a diff looks at.
+const (
+	FieldDownload = "download"
+	FieldBuild    = "build"
+	FieldTest     = "test"
+	FieldVet      = "vet"
+	FieldFmt      = "fmt"
+)
+
+// All diff fields, in the order they are reported.
+var DiffFields = []string{FieldDownload, FieldBuild, FieldTest, FieldVet, FieldFmt}
+
+// A change in a single aspect of a package. Was and Now are true if
+// the aspect passed in the old and new data respectively. NewFailures
+// and Fixed list the targets that started and stopped failing.
+type FieldChange struct {
+	Field       string   `json:"field"`
+	Was         bool     `json:"was"`
+	Now         bool     `json:"now"`
+	NewFailures []string `json:"newFailures,omitempty"`
+	Fixed       []string `json:"fixed,omitempty"`
+}
+
+// All changes for a package present in both datasets.
+type PackageDiff struct {
+	Name    string        `json:"name"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// The difference between two datasets.
+type Diff struct {
+	Added   []string      `json:"added"`
+	Removed []string      `json:"removed"`
+	Changed []PackageDiff `json:"changed"`
+}
+
+// Per-field counts of packages that started failing or passing.
+type DiffSummary struct {
+	Field        string `json:"field"`
+	StartFailing int    `json:"startFailing"`
+	StartPassing int    `json:"startPassing"`
+	Targets      int    `json:"targetsChanged"`
+}
+
+// Return whether a given aspect of a package passed, and the targets
+// that failed it.
+func fieldStatus(stats PackageStats, field string) (bool, []string) {
+	switch field {
+	case FieldDownload:
+		return stats.DownloadSucceeded, nil
+	case FieldBuild:
+		return stats.AllBuildsPass, stats.FailedBuilds
+	case FieldTest:
+		return stats.AllTestsPassed, stats.FailedTests
+	case FieldVet:
+		return len(stats.FailedVets) == 0, stats.FailedVets
+	case FieldFmt:
+		return len(stats.FailedFmt) == 0, stats.FailedFmt
+	}
+	return false, nil
+}
+
+// Return true if the given aspect (one of DiffFields) of a package
+// passed.
+func (p PackageStats) Passed(field string) bool {
+	passed, _ := fieldStatus(p, field)
+	return passed
+}
+
+// Return the elements of a that are not in b, sorted.
+func missingFrom(a, b []string) []string {
+	seen := make(map[string]bool)
+	for _, s := range b {
+		seen[s] = true
+	}
+
+	var rv []string
+	for _, s := range a {
+		if !seen[s] {
+			rv = append(rv, s)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// Compare a single package between two datasets, returning the
+// fields that changed.
+func diffPackage(old, new PackageStats) []FieldChange {
+	var rv []FieldChange
+
+	for _, field := range DiffFields {
+		was, oldFailed := fieldStatus(old, field)
+		now, newFailed := fieldStatus(new, field)
+		change := FieldChange{
+			Field:       field,
+			Was:         was,
+			Now:         now,
+			NewFailures: missingFrom(newFailed, oldFailed),
+			Fixed:       missingFrom(oldFailed, newFailed),
+		}
+		if was != now || len(change.NewFailures) > 0 || len(change.Fixed) > 0 {
+			rv = append(rv, change)
+		}
+	}
+
+	return rv
+}
+
+// Compute the difference between two datasets, going from old to
+// new.
+func DiffStores(old, new Store) Diff {
+	var rv Diff
+
+	oldData := make(map[string]PackageStats)
+	for pkg := range old.Iterate(context.Background()) {
+		oldData[pkg.Name] = pkg.Stats
+	}
+
+	seen := make(map[string]bool)
+	for pkg := range new.Iterate(context.Background()) {
+		seen[pkg.Name] = true
+		oldStats, ok := oldData[pkg.Name]
+		if !ok {
+			rv.Added = append(rv.Added, pkg.Name)
+			continue
+		}
+		changes := diffPackage(oldStats, pkg.Stats)
+		if len(changes) > 0 {
+			rv.Changed = append(rv.Changed, PackageDiff{pkg.Name, changes})
+		}
+	}
+
+	for name := range oldData {
+		if !seen[name] {
+			rv.Removed = append(rv.Removed, name)
+		}
+	}
+
+	sort.Strings(rv.Added)
+	sort.Strings(rv.Removed)
+	sort.Slice(rv.Changed, func(i, j int) bool {
+		return rv.Changed[i].Name < rv.Changed[j].Name
+	})
+
+	return rv
+}
+
+// Summarise a diff per field, in the order of DiffFields.
+func (d Diff) Summary() []DiffSummary {
+	counts := make(map[string]*DiffSummary)
+	var rv []DiffSummary
+
+	for _, field := range DiffFields {
+		counts[field] = &DiffSummary{Field: field}
+	}
+
+	for _, pkg := range d.Changed {
+		for _, change := range pkg.Changes {
+			c := counts[change.Field]
+			switch {
+			case change.Was && !change.Now:
+				c.StartFailing++
+			case !change.Was && change.Now:
+				c.StartPassing++
+			}
+			c.Targets += len(change.NewFailures) + len(change.Fixed)
+		}
+	}
+
+	for _, field := range DiffFields {
+		rv = append(rv, *counts[field])
+	}
+
+	return rv
+}
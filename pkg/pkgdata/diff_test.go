@@ -0,0 +1,60 @@
+package pkgdata
+
+import (
+	"testing"
+)
+
+func TestDiffStores(t *testing.T) {
+	old := NewMemoryStore()
+	old.Set("example.com/gone@v1.0.0", PackageStats{DownloadSucceeded: true})
+	old.Set("example.com/same@v1.0.0", PackageStats{DownloadSucceeded: true, AllBuildsPass: true})
+	old.Set("example.com/code@v1.0.0", PackageStats{
+		DownloadSucceeded: true,
+		AllBuildsPass:     true,
+		AllTestsPassed:    false,
+		FailedTests:       []string{"example.com/code/a"},
+	})
+
+	new := NewMemoryStore()
+	new.Set("example.com/added@v1.0.0", PackageStats{})
+	new.Set("example.com/same@v1.0.0", PackageStats{DownloadSucceeded: true, AllBuildsPass: true})
+	new.Set("example.com/code@v1.0.0", PackageStats{
+		DownloadSucceeded: true,
+		AllBuildsPass:     false,
+		FailedBuilds:      []string{"example.com/code/b"},
+		AllTestsPassed:    true,
+	})
+
+	d := DiffStores(old, new)
+
+	if len(d.Added) != 1 || d.Added[0] != "example.com/added@v1.0.0" {
+		t.Errorf("Added, got %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != "example.com/gone@v1.0.0" {
+		t.Errorf("Removed, got %v", d.Removed)
+	}
+	if len(d.Changed) != 1 {
+		t.Fatalf("Changed, got %v", d.Changed)
+	}
+
+	changes := d.Changed[0].Changes
+	if len(changes) != 2 || changes[0].Field != FieldBuild || changes[1].Field != FieldTest {
+		t.Fatalf("Changes, got %v", changes)
+	}
+	if len(changes[0].NewFailures) != 1 || len(changes[1].Fixed) != 1 {
+		t.Errorf("Changed targets, got %v", changes)
+	}
+
+	for _, s := range d.Summary() {
+		switch s.Field {
+		case FieldBuild:
+			if s.StartFailing != 1 {
+				t.Errorf("Build summary, got %v", s)
+			}
+		case FieldTest:
+			if s.StartPassing != 1 {
+				t.Errorf("Test summary, got %v", s)
+			}
+		}
+	}
+}
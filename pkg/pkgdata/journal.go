@@ -0,0 +1,117 @@
+package pkgdata
+
+// An append-only journal of store mutations, so that data reported
+// between two snapshots survives a crash.
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+const journalName = "journal"
+
+// Longest journal line we are prepared to read back.
+const maxJournalLine = 64 * 1024 * 1024
+
+const (
+	opEnsure  = "ensure"
+	opSet     = "set"
+	opRun     = "run"
+	opHistory = "history"
+	opPurge   = "purge"
+)
+
+// Entries with the "set" op come from before we kept run history, and
+// carry only the package stats. Seq numbers the entries, so that those
+// already in a snapshot can be skipped on replay; entries written
+// before we numbered them have none.
+type journalEntry struct {
+	Seq     uint64        `json:"seq,omitempty"`
+	Op      string        `json:"op"`
+	Package string        `json:"package"`
+	Data    *PackageStats `json:"data,omitempty"`
+	Run     *RunRecord    `json:"run,omitempty"`
+	History []RunRecord   `json:"history,omitempty"`
+}
+
+type journal struct {
+	path string
+	out  *os.File
+}
+
+// Append a single entry to the journal, opening the journal file if
+// needed.
+func (j *journal) append(entry journalEntry) error {
+	if j.out == nil {
+		out, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		j.out = out
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	_, err = j.out.Write(b)
+	return err
+}
+
+// Throw away everything in the journal. This should only be done
+// once the journal contents are safely in a snapshot.
+func (j *journal) truncate() error {
+	if j.out != nil {
+		j.out.Close()
+		j.out = nil
+	}
+
+	err := os.Remove(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Read all entries from the journal, calling f on each of them. A
+// journal that does not exist is treated as empty. A line that cannot
+// be decoded (typically a partial write just before a crash) is
+// logged and skipped.
+func (j *journal) replay(f func(journalEntry)) (int, error) {
+	in, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalLine)
+
+	count := 0
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"journal": j.path,
+				"line":    line,
+				"error":   err,
+			}).Warn("Skipping bad journal entry.")
+			continue
+		}
+		f(entry)
+		count++
+	}
+
+	return count, scanner.Err()
+}
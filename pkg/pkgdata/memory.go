@@ -0,0 +1,196 @@
+package pkgdata
+
+// An in-memory Store, mostly useful for tests and as the basis for
+// the on-disk stores.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type MemoryStore struct {
+	dataLock sync.Mutex
+	packages map[string]*packageRecord
+	clean    bool
+}
+
+// Return a new, empty, MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		packages: make(map[string]*packageRecord),
+		clean:    true,
+	}
+}
+
+// If we don't have any data about a given package, initialize an
+// empty PackageStats struct and store that. Return false if the
+// package didn't exist, otherwise return true.
+func (m *MemoryStore) Ensure(name string) bool {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	return m.ensure(name)
+}
+
+// Does the work of Ensure, the caller must hold the lock.
+func (m *MemoryStore) ensure(name string) bool {
+	_, ok := m.packages[name]
+	if !ok {
+		m.packages[name] = new(packageRecord)
+		m.clean = false
+		return false
+	}
+
+	return true
+}
+
+// Return a copy of the latest package data for a given package
+func (m *MemoryStore) Get(name string) (PackageStats, bool) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	rv, ok := m.packages[name]
+
+	if ok {
+		return rv.PackageStats, true
+	}
+	return PackageStats{}, false
+}
+
+// Return a copy of all recorded runs for a given package, oldest
+// first.
+func (m *MemoryStore) History(name string) ([]RunRecord, bool) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	rv, ok := m.packages[name]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]RunRecord(nil), rv.History...), true
+}
+
+// Record a run with the given package stats, at the current time and
+// with no information about the builder. This will set the state to
+// "not clean", even if we end up setting the exact same data that we
+// already had.
+func (m *MemoryStore) Set(name string, data PackageStats) {
+	m.AddRun(name, RunRecord{Time: time.Now(), Stats: data})
+}
+
+// Record a run for a given package, making its stats the latest
+// package data.
+func (m *MemoryStore) AddRun(name string, run RunRecord) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	m.addRun(name, run)
+}
+
+// Does the work of AddRun, the caller must hold the lock.
+func (m *MemoryStore) addRun(name string, run RunRecord) {
+	m.clean = false
+	blob, ok := m.packages[name]
+	if !ok {
+		blob = new(packageRecord)
+		m.packages[name] = blob
+	}
+
+	blob.PackageStats = run.Stats
+	blob.History = append(blob.History, run)
+}
+
+// Replace all recorded runs for a given package, the last run
+// becoming the latest package data.
+func (m *MemoryStore) SetHistory(name string, runs []RunRecord) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	m.setHistory(name, runs)
+}
+
+// Does the work of SetHistory, the caller must hold the lock.
+func (m *MemoryStore) setHistory(name string, runs []RunRecord) {
+	m.clean = false
+	record := &packageRecord{History: append([]RunRecord(nil), runs...)}
+	if len(runs) > 0 {
+		record.PackageStats = runs[len(runs)-1].Stats
+	}
+	m.packages[name] = record
+}
+
+// Delete a specific package from the statistics
+func (m *MemoryStore) Purge(name string) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	m.purge(name)
+}
+
+// Does the work of Purge, the caller must hold the lock.
+func (m *MemoryStore) purge(name string) {
+	m.clean = false
+
+	delete(m.packages, name)
+}
+
+// Returns a channel on which all packages with statistics will be
+// passed. The data is copied up front, so the iteration sees a
+// consistent snapshot and it is safe to keep modifying the store
+// while iterating. Cancelling ctx stops the iteration and closes the
+// channel.
+func (m *MemoryStore) Iterate(ctx context.Context) <-chan Package {
+	rv := make(chan Package)
+
+	m.dataLock.Lock()
+	data := make([]Package, 0, len(m.packages))
+	for pkg, record := range m.packages {
+		data = append(data, Package{pkg, record.PackageStats, len(record.History) == 0})
+	}
+	m.dataLock.Unlock()
+
+	go func() {
+		defer close(rv)
+		for _, pkg := range data {
+			select {
+			case rv <- pkg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rv
+}
+
+// There is nowhere to save to, so this only marks the data as "clean".
+func (m *MemoryStore) Save() error {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	m.clean = true
+	return nil
+}
+
+// A MemoryStore has nothing to load from.
+func (m *MemoryStore) Load(name string) error {
+	return fmt.Errorf("Cannot load %s into a memory store", name)
+}
+
+// Merge the contents of data into the store, overwriting any
+// packages that already exist, and mark the store as clean.
+func (m *MemoryStore) merge(data map[string]*packageRecord) {
+	m.dataLock.Lock()
+	defer m.dataLock.Unlock()
+
+	for key, val := range data {
+		if val == nil {
+			val = new(packageRecord)
+		}
+		m.packages[key] = val
+	}
+	m.clean = true
+}
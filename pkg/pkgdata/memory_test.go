@@ -0,0 +1,96 @@
+package pkgdata
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+
+	if s.Ensure("example.com/code@v1.0.0") {
+		t.Errorf("Ensure of new package, got true, want false")
+	}
+	if !s.Ensure("example.com/code@v1.0.0") {
+		t.Errorf("Ensure of seen package, got false, want true")
+	}
+
+	s.Set("example.com/code@v1.0.0", PackageStats{DownloadSucceeded: true, BuildableTargets: 3})
+	s.Set("example.com/other@v1.0.0", PackageStats{})
+
+	got, ok := s.Get("example.com/code@v1.0.0")
+	if !ok {
+		t.Fatalf("Get, package not found")
+	}
+	if !got.DownloadSucceeded || got.BuildableTargets != 3 {
+		t.Errorf("Get, got %v", got)
+	}
+
+	if n := PurgeDownloadFailed(s); n != 1 {
+		t.Errorf("PurgeDownloadFailed, got %d, want 1", n)
+	}
+	if PackageSeen(s, "example.com/other@v1.0.0") {
+		t.Errorf("Package seen after purge")
+	}
+
+	count := 0
+	for _ = range s.Iterate(context.Background()) {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Iterate, got %d packages, want 1", count)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := NewMemoryStore()
+
+	s.AddRun("example.com/code@v1.0.0", RunRecord{Toolchain: "go1.15", Stats: PackageStats{AllBuildsPass: false}})
+	s.AddRun("example.com/code@v1.0.0", RunRecord{Toolchain: "go1.16", Stats: PackageStats{AllBuildsPass: true}})
+
+	latest, _ := s.Get("example.com/code@v1.0.0")
+	if !latest.AllBuildsPass {
+		t.Errorf("Latest run, got %v, want AllBuildsPass", latest)
+	}
+
+	history, ok := s.History("example.com/code@v1.0.0")
+	if !ok {
+		t.Fatalf("History, package not found")
+	}
+	if len(history) != 2 {
+		t.Fatalf("History, got %d runs, want 2", len(history))
+	}
+	if history[0].Toolchain != "go1.15" || history[1].Toolchain != "go1.16" {
+		t.Errorf("History out of order, got %v", history)
+	}
+}
+
+func TestIterateConcurrent(t *testing.T) {
+	s := NewMemoryStore()
+	for _, name := range []string{"a@v1", "b@v1", "c@v1"} {
+		s.Set(name, PackageStats{})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pkgs := s.Iterate(ctx)
+
+	// Mutating the store mid-iteration must not affect what we see.
+	<-pkgs
+	s.Set("d@v1", PackageStats{})
+	s.Purge("a@v1")
+
+	count := 1
+	for _ = range pkgs {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("Iterate, got %d packages, want 3", count)
+	}
+
+	// An abandoned iteration closes its channel once cancelled.
+	pkgs = s.Iterate(ctx)
+	<-pkgs
+	cancel()
+	for _ = range pkgs {
+	}
+}
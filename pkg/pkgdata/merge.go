@@ -0,0 +1,174 @@
+package pkgdata
+
+// Merging of datasets from independent crawls.
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// How to resolve a package that exists, with different data, in both
+// datasets being merged.
+type ConflictPolicy int
+
+const (
+	// Keep whichever side has the most recent run.
+	NewestWins ConflictPolicy = iota
+	// Keep whichever side passed more checks, newest on a tie.
+	PreferSuccess
+	// Keep whichever side failed more checks, newest on a tie.
+	PreferFailure
+	// Keep the runs from both sides, ordered by time.
+	KeepBoth
+)
+
+var policyNames = map[string]ConflictPolicy{
+	"newest":  NewestWins,
+	"success": PreferSuccess,
+	"failure": PreferFailure,
+	"history": KeepBoth,
+}
+
+// Parse a conflict policy name, one of "newest", "success",
+// "failure" or "history".
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	rv, ok := policyNames[name]
+	if !ok {
+		return rv, fmt.Errorf("Unknown conflict policy, %s", name)
+	}
+	return rv, nil
+}
+
+// The outcomes of resolving a conflict.
+const (
+	ResolvedKept     = "kept"
+	ResolvedReplaced = "replaced"
+	ResolvedCombined = "combined"
+)
+
+// A conflict found while merging, and how it was resolved.
+type Conflict struct {
+	Name       string
+	Resolution string
+}
+
+// Return all runs for a package, synthesising a single run from the
+// latest data for packages that have no history. Pending packages,
+// with nothing recorded, have no runs.
+func runsOf(s Store, name string) []RunRecord {
+	runs, _ := s.History(name)
+	if len(runs) > 0 {
+		return runs
+	}
+
+	stats, ok := s.Get(name)
+	if !ok || stats.empty() {
+		return nil
+	}
+	return []RunRecord{{Stats: stats}}
+}
+
+// Count how many of the diff fields passed.
+func passCount(stats PackageStats) int {
+	rv := 0
+	for _, field := range DiffFields {
+		if passed, _ := fieldStatus(stats, field); passed {
+			rv++
+		}
+	}
+	return rv
+}
+
+// Return true if the src side of a conflict should replace the dst
+// side.
+func (p ConflictPolicy) replaces(dst, src RunRecord) bool {
+	newer := src.Time.After(dst.Time)
+
+	switch p {
+	case PreferSuccess:
+		d, s := passCount(dst.Stats), passCount(src.Stats)
+		if d != s {
+			return s > d
+		}
+	case PreferFailure:
+		d, s := passCount(dst.Stats), passCount(src.Stats)
+		if d != s {
+			return s < d
+		}
+	}
+
+	return newer
+}
+
+// Combine two run histories, dropping duplicates and ordering the
+// result by time.
+func combineRuns(a, b []RunRecord) []RunRecord {
+	rv := append([]RunRecord(nil), a...)
+
+	for _, run := range b {
+		dup := false
+		for _, seen := range a {
+			if reflect.DeepEqual(run, seen) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rv = append(rv, run)
+		}
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Time.Before(rv[j].Time)
+	})
+
+	return rv
+}
+
+// Merge all packages from src into dst, resolving packages present
+// with different data in both according to the policy. Returns the
+// conflicts found, sorted by package name.
+func Merge(dst, src Store, policy ConflictPolicy) []Conflict {
+	var conflicts []Conflict
+	var names []string
+
+	for pkg := range src.Iterate(context.Background()) {
+		names = append(names, pkg.Name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		srcRuns := runsOf(src, name)
+		dstRuns := runsOf(dst, name)
+
+		if len(srcRuns) == 0 {
+			dst.Ensure(name)
+			continue
+		}
+		if len(dstRuns) == 0 {
+			dst.SetHistory(name, srcRuns)
+			continue
+		}
+
+		dstLatest := dstRuns[len(dstRuns)-1]
+		srcLatest := srcRuns[len(srcRuns)-1]
+		if reflect.DeepEqual(dstLatest.Stats, srcLatest.Stats) {
+			continue
+		}
+
+		conflict := Conflict{Name: name, Resolution: ResolvedKept}
+		switch {
+		case policy == KeepBoth:
+			dst.SetHistory(name, combineRuns(dstRuns, srcRuns))
+			conflict.Resolution = ResolvedCombined
+		case policy.replaces(dstLatest, srcLatest):
+			dst.SetHistory(name, srcRuns)
+			conflict.Resolution = ResolvedReplaced
+		}
+		conflicts = append(conflicts, conflict)
+	}
+
+	return conflicts
+}
@@ -0,0 +1,60 @@
+package pkgdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	early := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	pass := PackageStats{DownloadSucceeded: true, AllBuildsPass: true, AllTestsPassed: true}
+	fail := PackageStats{DownloadSucceeded: true}
+
+	cases := []struct {
+		policy     ConflictPolicy
+		want       bool
+		history    int
+		resolution string
+	}{
+		{NewestWins, false, 1, ResolvedReplaced},
+		{PreferSuccess, true, 1, ResolvedKept},
+		{PreferFailure, false, 1, ResolvedReplaced},
+		{KeepBoth, false, 2, ResolvedCombined},
+	}
+
+	for ix, c := range cases {
+		dst := NewMemoryStore()
+		dst.AddRun("example.com/code@v1.0.0", RunRecord{Time: early, Stats: pass})
+		src := NewMemoryStore()
+		src.AddRun("example.com/code@v1.0.0", RunRecord{Time: late, Stats: fail})
+		src.AddRun("example.com/other@v1.0.0", RunRecord{Time: late, Stats: fail})
+		src.Ensure("example.com/code@v1.1.0")
+		dst.AddRun("example.com/other@v1.1.0", RunRecord{Time: early, Stats: pass})
+		src.Ensure("example.com/other@v1.1.0")
+
+		conflicts := Merge(dst, src, c.policy)
+		if len(conflicts) != 1 || conflicts[0].Resolution != c.resolution {
+			t.Errorf("Case #%d, got conflicts %v", ix, conflicts)
+		}
+
+		got, _ := dst.Get("example.com/code@v1.0.0")
+		if got.AllBuildsPass != c.want {
+			t.Errorf("Case #%d, got %v", ix, got)
+		}
+		history, _ := dst.History("example.com/code@v1.0.0")
+		if len(history) != c.history {
+			t.Errorf("Case #%d, got %d runs, want %d", ix, len(history), c.history)
+		}
+		if !PackageSeen(dst, "example.com/other@v1.0.0") {
+			t.Errorf("Case #%d, package only in source not merged", ix)
+		}
+		if history, ok := dst.History("example.com/code@v1.1.0"); !ok || len(history) != 0 {
+			t.Errorf("Case #%d, pending package, got %v, %v", ix, history, ok)
+		}
+		if got, _ := dst.Get("example.com/other@v1.1.0"); !got.AllBuildsPass {
+			t.Errorf("Case #%d, pending package replaced a run, got %v", ix, got)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pkgdata
+
+// Retention of snapshot files in the data directory. Pinned snapshots
+// and the newest snapshot are always kept; everything else is kept
+// only if the retention policy asks for it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const snapshotPrefix = "pkgdata-"
+const pinsName = "pins.json"
+
+// How many snapshots to keep. A zero value for all fields keeps every
+// snapshot.
+type RetentionPolicy struct {
+	// Keep the N newest snapshots.
+	KeepLast int `json:"keepLast"`
+	// Keep the newest snapshot for each of the last N days that
+	// have snapshots.
+	KeepDaily int `json:"keepDaily"`
+	// Keep the newest snapshot for each of the last N weeks that
+	// have snapshots.
+	KeepWeekly int `json:"keepWeekly"`
+}
+
+// Information about a single snapshot file.
+type SnapshotInfo struct {
+	Name   string
+	Path   string
+	Time   time.Time
+	Pinned bool
+	Label  string
+}
+
+// Return true if the policy keeps everything.
+func (p RetentionPolicy) KeepAll() bool {
+	return p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0
+}
+
+// Split snaps (sorted oldest first) into the ones the policy keeps
+// and the ones it removes. Snapshots with no parseable time are
+// always kept.
+func (p RetentionPolicy) Select(snaps []SnapshotInfo) (keep, remove []SnapshotInfo) {
+	if p.KeepAll() {
+		return snaps, nil
+	}
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+
+	kept := make([]bool, len(snaps))
+	for ix := len(snaps) - 1; ix >= 0; ix-- {
+		snap := snaps[ix]
+		newer := len(snaps) - 1 - ix
+
+		if snap.Pinned || snap.Time.IsZero() || newer == 0 || newer < p.KeepLast {
+			kept[ix] = true
+		}
+
+		day := snap.Time.Format("2006-01-02")
+		if !days[day] && len(days) < p.KeepDaily {
+			days[day] = true
+			kept[ix] = true
+		}
+
+		year, week := snap.Time.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if !weeks[weekKey] && len(weeks) < p.KeepWeekly {
+			weeks[weekKey] = true
+			kept[ix] = true
+		}
+	}
+
+	for ix, snap := range snaps {
+		if kept[ix] {
+			keep = append(keep, snap)
+		} else {
+			remove = append(remove, snap)
+		}
+	}
+
+	return keep, remove
+}
+
+// Set the retention policy applied after each Save.
+func (s *SnapshotStore) SetRetention(p RetentionPolicy) {
+	s.retention = p
+}
+
+// Return all snapshots in the data directory, oldest first.
+func (s *SnapshotStore) Snapshots() ([]SnapshotInfo, error) {
+	names, err := filepath.Glob(filepath.Join(s.storagePath, snapshotPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	pins, err := s.pins()
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []SnapshotInfo
+	for _, path := range names {
+		name := filepath.Base(path)
+		label, pinned := pins[name]
+		t, _ := time.Parse(time.RFC3339, strings.TrimPrefix(name, snapshotPrefix))
+		rv = append(rv, SnapshotInfo{
+			Name:   name,
+			Path:   path,
+			Time:   t,
+			Pinned: pinned,
+			Label:  label,
+		})
+	}
+
+	return rv, nil
+}
+
+// Read the pinned snapshots, as a map from snapshot name to label.
+func (s *SnapshotStore) pins() (map[string]string, error) {
+	rv := make(map[string]string)
+
+	b, err := ioutil.ReadFile(filepath.Join(s.storagePath, pinsName))
+	if os.IsNotExist(err) {
+		return rv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
+
+func (s *SnapshotStore) writePins(pins map[string]string) error {
+	b, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(s.storagePath, pinsName), b, 0644)
+}
+
+// Pin a snapshot, so it is never removed by retention, optionally
+// giving it a label.
+func (s *SnapshotStore) Pin(name, label string) error {
+	name = filepath.Base(name)
+	if _, err := os.Stat(filepath.Join(s.storagePath, name)); err != nil {
+		return err
+	}
+
+	pins, err := s.pins()
+	if err != nil {
+		return err
+	}
+	pins[name] = label
+
+	return s.writePins(pins)
+}
+
+// Remove the pin from a snapshot.
+func (s *SnapshotStore) Unpin(name string) error {
+	pins, err := s.pins()
+	if err != nil {
+		return err
+	}
+	delete(pins, filepath.Base(name))
+
+	return s.writePins(pins)
+}
+
+// Apply the retention policy to the snapshots in the data directory,
+// returning the snapshots that were removed.
+func (s *SnapshotStore) Prune() ([]SnapshotInfo, error) {
+	return s.PruneWith(s.retention)
+}
+
+// Apply a specific retention policy to the snapshots in the data
+// directory, returning the snapshots that were removed.
+func (s *SnapshotStore) PruneWith(p RetentionPolicy) ([]SnapshotInfo, error) {
+	snaps, err := s.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	_, remove := p.Select(snaps)
+
+	var removed []SnapshotInfo
+	for _, snap := range remove {
+		err := os.Remove(snap.Path)
+		if err != nil {
+			return removed, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"name": snap.Name,
+		}).Info("Removed snapshot.")
+		removed = append(removed, snap)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,54 @@
+package pkgdata
+
+import (
+	"testing"
+	"time"
+)
+
+func fakeSnapshots(times ...string) []SnapshotInfo {
+	var rv []SnapshotInfo
+
+	for _, s := range times {
+		t, _ := time.Parse(time.RFC3339, s)
+		rv = append(rv, SnapshotInfo{Name: snapshotPrefix + s, Time: t})
+	}
+
+	return rv
+}
+
+func TestRetentionSelect(t *testing.T) {
+	snaps := fakeSnapshots(
+		"2022-02-01T10:00:00Z",
+		"2022-02-01T11:00:00Z",
+		"2022-02-09T10:00:00Z",
+		"2022-02-10T10:00:00Z",
+		"2022-02-10T11:00:00Z",
+		"2022-02-10T12:00:00Z",
+	)
+	snaps[0].Pinned = true
+
+	cases := []struct {
+		policy RetentionPolicy
+		want   int
+	}{
+		{RetentionPolicy{}, 6},
+		{RetentionPolicy{KeepLast: 1}, 2},
+		{RetentionPolicy{KeepLast: 2}, 3},
+		{RetentionPolicy{KeepDaily: 2}, 3},
+		{RetentionPolicy{KeepWeekly: 2}, 3},
+		{RetentionPolicy{KeepLast: 1, KeepDaily: 3}, 4},
+	}
+
+	for ix, c := range cases {
+		keep, remove := c.policy.Select(snaps)
+		if len(keep) != c.want {
+			t.Errorf("Case #%d, kept %d, want %d", ix, len(keep), c.want)
+		}
+		if len(keep)+len(remove) != len(snaps) {
+			t.Errorf("Case #%d, lost snapshots, %d + %d != %d", ix, len(keep), len(remove), len(snaps))
+		}
+		if keep[0].Name != snaps[0].Name {
+			t.Errorf("Case #%d, pinned snapshot not kept", ix)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package pkgdata
+
+// Versioning of the on-disk snapshot format. Every snapshot carries a
+// header with the schema version it was written with, and loading an
+// older snapshot runs it through the registered migrations, one
+// version at a time, until it is at the current version.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The schema version written by Save.
+//
+// Version 0 is the original headerless format, a bare JSON map from
+// package name to package stats. Version 1 wraps that in a header,
+// and package entries may carry a run history. In version 2, every
+// package that is not pending has a run history. Snapshots written
+// since the checksum was introduced carry a SHA-256 of the packages
+// JSON in the header; older ones are loaded unverified.
+const SchemaVersion = 2
+
+// Metadata about a snapshot.
+type SnapshotHeader struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Created       time.Time `json:"created"`
+	Host          string    `json:"host,omitempty"`
+	Program       string    `json:"program,omitempty"`
+	Packages      int       `json:"packages"`
+	Checksum      string    `json:"checksum,omitempty"`
+	// The sequence number of the last journal entry included.
+	JournalSeq uint64 `json:"journalSeq,omitempty"`
+}
+
+type snapshot struct {
+	Header   SnapshotHeader            `json:"header"`
+	Packages map[string]*packageRecord `json:"packages"`
+}
+
+// A snapshot with the package data left undecoded, so we can verify
+// the checksum over the exact bytes.
+type rawSnapshot struct {
+	Header   SnapshotHeader  `json:"header"`
+	Packages json.RawMessage `json:"packages"`
+}
+
+// Return the checksum of the (JSON-encoded) package data.
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Encode a snapshot, with a checksummed header, including journal
+// entries up to journalSeq.
+func encodeSnapshot(packages map[string]*packageRecord, journalSeq uint64) ([]byte, error) {
+	b, err := json.Marshal(packages)
+	if err != nil {
+		return nil, err
+	}
+
+	header := newHeader(len(packages))
+	header.Checksum = checksum(b)
+	header.JournalSeq = journalSeq
+
+	return json.Marshal(rawSnapshot{Header: header, Packages: b})
+}
+
+// A Migration takes a snapshot, in JSON form, at one schema version
+// and returns it converted to the next schema version.
+type Migration func([]byte) ([]byte, error)
+
+var migrations = map[int]Migration{
+	0: migrateHeaderless,
+	1: migrateHistory,
+}
+
+// Register a migration from schema version from to version from+1.
+func RegisterMigration(from int, m Migration) {
+	migrations[from] = m
+}
+
+// Build a header for a snapshot being written now.
+func newHeader(packages int) SnapshotHeader {
+	host, _ := os.Hostname()
+	return SnapshotHeader{
+		SchemaVersion: SchemaVersion,
+		Created:       time.Now(),
+		Host:          host,
+		Program:       filepath.Base(os.Args[0]),
+		Packages:      packages,
+	}
+}
+
+// Find the schema version of a snapshot in JSON form. Anything
+// without a header is version 0.
+func schemaVersion(b []byte) (int, error) {
+	var probe map[string]json.RawMessage
+
+	err := json.Unmarshal(b, &probe)
+	if err != nil {
+		return 0, err
+	}
+
+	raw, ok := probe["header"]
+	if !ok {
+		return 0, nil
+	}
+
+	var header SnapshotHeader
+	err = json.Unmarshal(raw, &header)
+	if err != nil {
+		return 0, err
+	}
+
+	return header.SchemaVersion, nil
+}
+
+// Decode a snapshot, migrating it to the current schema version if
+// needed.
+func decodeSnapshot(b []byte) (snapshot, error) {
+	var rv snapshot
+
+	version, err := schemaVersion(b)
+	if err != nil {
+		return rv, err
+	}
+	if version > SchemaVersion {
+		return rv, fmt.Errorf("Snapshot schema version %d is newer than %d", version, SchemaVersion)
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return rv, fmt.Errorf("No migration from schema version %d", v)
+		}
+		logrus.WithFields(logrus.Fields{
+			"from": v,
+			"to":   v + 1,
+		}).Info("Migrating snapshot.")
+		b, err = m(b)
+		if err != nil {
+			return rv, err
+		}
+	}
+
+	var raw rawSnapshot
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return rv, err
+	}
+	if raw.Header.Checksum != "" && raw.Header.Checksum != checksum(raw.Packages) {
+		return rv, fmt.Errorf("Snapshot checksum mismatch, header says %s", raw.Header.Checksum)
+	}
+
+	rv.Header = raw.Header
+	if len(raw.Packages) > 0 {
+		err = json.Unmarshal(raw.Packages, &rv.Packages)
+	}
+	if rv.Packages == nil {
+		rv.Packages = make(map[string]*packageRecord)
+	}
+
+	return rv, err
+}
+
+// Wrap a headerless snapshot in a header. We cannot tell which of
+// the later-added fields (like failedFmt) the data had, so this is
+// logged, and the creation time is left at zero.
+func migrateHeaderless(b []byte) ([]byte, error) {
+	var packages map[string]json.RawMessage
+
+	err := json.Unmarshal(b, &packages)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Warn("Headerless snapshot, fields added after it was written may be missing.")
+
+	return json.Marshal(struct {
+		Header   SnapshotHeader             `json:"header"`
+		Packages map[string]json.RawMessage `json:"packages"`
+	}{
+		Header:   SnapshotHeader{SchemaVersion: 1, Packages: len(packages)},
+		Packages: packages,
+	})
+}
+
+// Give every package without a run history a single run with its
+// latest stats. Packages saved before we kept history have none, and
+// would otherwise count as pending. Packages that were pending when
+// the snapshot was written cannot be told apart from those, and are
+// counted as download failures until they report.
+func migrateHistory(b []byte) ([]byte, error) {
+	var raw rawSnapshot
+
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw.Header.Checksum != "" && raw.Header.Checksum != checksum(raw.Packages) {
+		return nil, fmt.Errorf("Snapshot checksum mismatch, header says %s", raw.Header.Checksum)
+	}
+
+	var packages map[string]*packageRecord
+	if len(raw.Packages) > 0 {
+		err = json.Unmarshal(raw.Packages, &packages)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range packages {
+		if record != nil && len(record.History) == 0 {
+			record.History = []RunRecord{{Stats: record.PackageStats}}
+		}
+	}
+
+	raw.Packages, err = json.Marshal(packages)
+	if err != nil {
+		return nil, err
+	}
+	raw.Header.SchemaVersion = 2
+	if raw.Header.Checksum != "" {
+		raw.Header.Checksum = checksum(raw.Packages)
+	}
+
+	return json.Marshal(raw)
+}
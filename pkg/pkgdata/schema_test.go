@@ -0,0 +1,79 @@
+package pkgdata
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeSnapshot(t *testing.T) {
+	cases := []struct {
+		data    string
+		version int
+		count   int
+	}{
+		{`{"example.com/code@v1.0.0": {"downloadSucceeded": true}}`, 0, 1},
+		{`{"header": {"schemaVersion": 1}, "packages": {"example.com/code@v1.0.0": {"downloadSucceeded": true}}}`, 1, 1},
+		{`{}`, 0, 0},
+	}
+
+	for ix, c := range cases {
+		version, err := schemaVersion([]byte(c.data))
+		if err != nil {
+			t.Fatalf("Case #%d, %v", ix, err)
+		}
+		if version != c.version {
+			t.Errorf("Case #%d, got version %d, want %d", ix, version, c.version)
+		}
+
+		snap, err := decodeSnapshot([]byte(c.data))
+		if err != nil {
+			t.Fatalf("Case #%d, %v", ix, err)
+		}
+		if snap.Header.SchemaVersion != SchemaVersion {
+			t.Errorf("Case #%d, got version %d after migration, want %d", ix, snap.Header.SchemaVersion, SchemaVersion)
+		}
+		if len(snap.Packages) != c.count {
+			t.Errorf("Case #%d, got %d packages, want %d", ix, len(snap.Packages), c.count)
+		}
+	}
+}
+
+func TestDecodeFutureSnapshot(t *testing.T) {
+	b, _ := json.Marshal(snapshot{Header: SnapshotHeader{SchemaVersion: SchemaVersion + 1}})
+	if _, err := decodeSnapshot(b); err == nil {
+		t.Errorf("Decoding a snapshot from the future, got no error")
+	}
+}
+
+func TestMigrateHistory(t *testing.T) {
+	cases := []struct {
+		data string
+		runs int
+	}{
+		{`{"example.com/code@v1.0.0": {"downloadSucceeded": false}}`, 1},
+		{`{"header": {"schemaVersion": 1}, "packages": {"example.com/code@v1.0.0": {"downloadSucceeded": false}}}`, 1},
+		{`{"header": {"schemaVersion": 1}, "packages": {"example.com/code@v1.0.0": {"downloadSucceeded": true, "history": [{"stats": {}}, {"stats": {"downloadSucceeded": true}}]}}}`, 2},
+		{`{"header": {"schemaVersion": 2}, "packages": {"example.com/code@v1.0.0": {"downloadSucceeded": false}}}`, 0},
+	}
+
+	for ix, c := range cases {
+		snap, err := decodeSnapshot([]byte(c.data))
+		if err != nil {
+			t.Fatalf("Case #%d, %v", ix, err)
+		}
+		record := snap.Packages["example.com/code@v1.0.0"]
+		if record == nil || len(record.History) != c.runs {
+			t.Errorf("Case #%d, got %v, want %d runs", ix, record, c.runs)
+		}
+	}
+
+	b, _ := encodeSnapshot(map[string]*packageRecord{"example.com/code@v1.0.0": {}}, 0)
+	var raw rawSnapshot
+	json.Unmarshal(b, &raw)
+	raw.Header.SchemaVersion = 1
+	raw.Packages = []byte(`{"example.com/code@v1.0.0": {"downloadSucceeded": true}}`)
+	b, _ = json.Marshal(raw)
+	if _, err := decodeSnapshot(b); err == nil {
+		t.Errorf("Migrating a damaged snapshot, got no error")
+	}
+}
@@ -0,0 +1,377 @@
+package pkgdata
+
+// A Store that keeps its data in memory, persisting it as JSON
+// snapshot files in a data directory. Every mutation is also written
+// to a journal, which is folded into the next snapshot on save.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/metrics"
+)
+
+var snapshotSaves = metrics.NewCounter("gochecker_snapshot_saves_total", "Snapshots written.")
+var snapshotSaveSeconds = metrics.NewCounter("gochecker_snapshot_save_seconds_total", "Total time spent writing snapshots.")
+var snapshotLastSeconds = metrics.NewGauge("gochecker_snapshot_last_save_seconds", "Time taken to write the latest snapshot.")
+var snapshotLastBytes = metrics.NewGauge("gochecker_snapshot_last_size_bytes", "Size of the latest snapshot.")
+
+type SnapshotStore struct {
+	MemoryStore
+	storagePath string
+	journal     journal
+	retention   RetentionPolicy
+	// The sequence number of the last journal entry written,
+	// protected by the lock.
+	seq uint64
+}
+
+// Return a new SnapshotStore, keeping its state files in the given
+// directory.
+func NewSnapshotStore(storagePath string) (*SnapshotStore, error) {
+	info, err := os.Stat(storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsDir() {
+		return nil, fmt.Errorf("Not a directory, %s", storagePath)
+	}
+
+	rv := &SnapshotStore{storagePath: storagePath}
+	rv.journal.path = filepath.Join(storagePath, journalName)
+	rv.packages = make(map[string]*packageRecord)
+	rv.clean = true
+
+	return rv, nil
+}
+
+// Record a mutation in the journal. The caller must hold the lock.
+func (s *SnapshotStore) record(entry journalEntry) {
+	s.seq++
+	entry.Seq = s.seq
+	err := s.journal.append(entry)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"op":      entry.Op,
+			"package": entry.Package,
+			"error":   err,
+		}).Error("Writing journal")
+	}
+}
+
+// If we don't have any data about a given package, initialize an
+// empty PackageStats struct and store that. Return false if the
+// package didn't exist, otherwise return true.
+func (s *SnapshotStore) Ensure(name string) bool {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	if s.ensure(name) {
+		return true
+	}
+	s.record(journalEntry{Op: opEnsure, Package: name})
+
+	return false
+}
+
+// Record a run with the given package stats, at the current time and
+// with no information about the builder, and journal the change.
+func (s *SnapshotStore) Set(name string, data PackageStats) {
+	s.AddRun(name, RunRecord{Time: time.Now(), Stats: data})
+}
+
+// Record a run for a given package, and journal the change.
+func (s *SnapshotStore) AddRun(name string, run RunRecord) {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	s.addRun(name, run)
+	s.record(journalEntry{Op: opRun, Package: name, Run: &run})
+}
+
+// Replace all recorded runs for a given package, and journal the
+// change.
+func (s *SnapshotStore) SetHistory(name string, runs []RunRecord) {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	s.setHistory(name, runs)
+	s.record(journalEntry{Op: opHistory, Package: name, History: runs})
+}
+
+// Delete a specific package from the statistics, and journal the
+// change.
+func (s *SnapshotStore) Purge(name string) {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	s.purge(name)
+	s.record(journalEntry{Op: opPurge, Package: name})
+}
+
+// Save package state to disk if there's been any changes since last
+// save. Mark the data as "clean". Once the snapshot is written, the
+// journal is no longer needed and is truncated, and the retention
+// policy is applied to older snapshots.
+func (s *SnapshotStore) Save() error {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	if s.clean {
+		return nil
+	}
+
+	start := time.Now()
+	filename := snapshotPrefix + start.Format(time.RFC3339)
+	target := filepath.Join(s.storagePath, filename)
+
+	b, err := encodeSnapshot(s.packages, s.seq)
+	if err != nil {
+		return err
+	}
+
+	err = writeAtomic(target, b)
+	if err != nil {
+		return err
+	}
+	s.clean = true
+
+	elapsed := time.Since(start).Seconds()
+	snapshotSaves.Inc()
+	snapshotSaveSeconds.Add(elapsed)
+	snapshotLastSeconds.Set(elapsed)
+	snapshotLastBytes.Set(float64(len(b)))
+
+	err = s.journal.truncate()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Prune()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Pruning snapshots")
+	}
+
+	return nil
+}
+
+// Write data to target, such that target either ends up with all of
+// data or is left untouched. The data is written to a temporary file
+// in the same directory, synced to disk, and then renamed.
+func writeAtomic(target string, data []byte) error {
+	dir := filepath.Dir(target)
+
+	out, err := ioutil.TempFile(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	tmpName := out.Name()
+
+	_, err = out.Write(data)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = os.Rename(tmpName, target)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// Make sure the rename itself is on disk.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Read a snapshot file from disk, migrating it from older schema
+// versions as needed.
+func readSnapshot(name string) (snapshot, error) {
+	source, err := os.Open(name)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"filename": name,
+			"error":    err,
+		}).Error("Opening file")
+		return snapshot{}, err
+	}
+	defer source.Close()
+
+	b, err := ioutil.ReadAll(source)
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	snap, err := decodeSnapshot(b)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to unmarshal save file.")
+		return snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+// Load a single snapshot file into a new MemoryStore, without
+// involving a data directory.
+func OpenSnapshot(name string) (*MemoryStore, error) {
+	snap, err := readSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := NewMemoryStore()
+	rv.merge(snap.Packages)
+
+	return rv, nil
+}
+
+// Load package state from disk, migrating it from older schema
+// versions as needed.
+func (s *SnapshotStore) Load(name string) error {
+	snap, err := readSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	s.merge(snap.Packages)
+
+	logrus.WithFields(logrus.Fields{
+		"name":    name,
+		"created": snap.Header.Created,
+		"host":    snap.Header.Host,
+		"program": snap.Header.Program,
+	}).Info("Loading complete.")
+
+	return nil
+}
+
+// Apply all journalled mutations on top of the current data, skipping
+// the ones numbered up to after, which are already in the loaded
+// snapshot. Those are left behind if we crash between writing a
+// snapshot and truncating the journal. Any replayed entries leave the
+// store "not clean", so the next Save folds them into a new snapshot.
+func (s *SnapshotStore) replayJournal(after uint64) error {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+
+	s.seq = after
+	skipped := 0
+	count, err := s.journal.replay(func(entry journalEntry) {
+		if entry.Seq != 0 && entry.Seq <= after {
+			skipped++
+			return
+		}
+		if entry.Seq > s.seq {
+			s.seq = entry.Seq
+		}
+
+		switch entry.Op {
+		case opEnsure:
+			s.ensure(entry.Package)
+		case opSet:
+			if entry.Data != nil {
+				s.addRun(entry.Package, RunRecord{Stats: *entry.Data})
+			}
+		case opRun:
+			if entry.Run != nil {
+				s.addRun(entry.Package, *entry.Run)
+			}
+		case opHistory:
+			s.setHistory(entry.Package, entry.History)
+		case opPurge:
+			s.purge(entry.Package)
+		default:
+			logrus.WithFields(logrus.Fields{
+				"op":      entry.Op,
+				"package": entry.Package,
+			}).Warn("Unknown journal operation.")
+		}
+	})
+	if count > skipped {
+		s.clean = false
+	}
+	logrus.WithFields(logrus.Fields{
+		"entries": count - skipped,
+		"skipped": skipped,
+	}).Info("Journal replayed.")
+
+	return err
+}
+
+// Load the latest file from disk, then replay the journal on top of
+// it. If there are snapshots but none of them can be read, the
+// journal is still replayed and an error returned; the caller should
+// not go on to save, as that would replace the damaged snapshots with
+// only what was in the journal.
+func (s *SnapshotStore) LoadLatest() error {
+	pattern := filepath.Join(s.storagePath, snapshotPrefix+"*")
+	names, err := filepath.Glob(pattern)
+	logrus.WithFields(logrus.Fields{
+		"pattern": pattern,
+		"names":   names,
+	}).Debug("Loading latest.")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"pattern": pattern,
+			"error":   err,
+		}).Error("Globbing for latest.")
+		return err
+	}
+
+	if len(names) == 0 {
+		logrus.Info("No save files.")
+		return s.replayJournal(0)
+	}
+
+	// Fall back to older snapshots if the newer ones are damaged.
+	for ix := len(names) - 1; ix >= 0; ix-- {
+		name := names[ix]
+		logrus.WithFields(logrus.Fields{
+			"name": name,
+		}).Debug("About to load data.")
+		snap, err := readSnapshot(name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"name":  name,
+				"error": err,
+			}).Warn("Skipping unreadable snapshot.")
+			continue
+		}
+
+		s.merge(snap.Packages)
+		logrus.WithFields(logrus.Fields{
+			"name":    name,
+			"skipped": len(names) - 1 - ix,
+		}).Info("Loading complete.")
+
+		return s.replayJournal(snap.Header.JournalSeq)
+	}
+
+	err = fmt.Errorf("No readable snapshot among %d in %s", len(names), s.storagePath)
+	if replayErr := s.replayJournal(0); replayErr != nil {
+		err = fmt.Errorf("%v, and replaying the journal failed: %v", err, replayErr)
+	}
+	return err
+}
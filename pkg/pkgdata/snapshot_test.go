@@ -0,0 +1,189 @@
+package pkgdata
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Ensure("example.com/code@v1.0.0")
+	s.Set("example.com/code@v1.0.0", PackageStats{DownloadSucceeded: true})
+	s.Ensure("example.com/gone@v1.0.0")
+	s.Purge("example.com/gone@v1.0.0")
+
+	// No save, simulating a crash between snapshots.
+	restarted, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadLatest(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := restarted.Get("example.com/code@v1.0.0")
+	if !ok || !got.DownloadSucceeded {
+		t.Errorf("Replayed package, got %v (found: %v)", got, ok)
+	}
+	if PackageSeen(restarted, "example.com/gone@v1.0.0") {
+		t.Errorf("Purged package present after replay")
+	}
+
+	if err := restarted.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalName)); !os.IsNotExist(err) {
+		t.Errorf("Journal still present after save, %v", err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "pkgdata-*"))
+	if len(names) != 1 {
+		t.Errorf("Snapshots after save, got %d, want 1", len(names))
+	}
+}
+
+func TestJournalReplayAfterSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("example.com/code@v1.0.0", PackageStats{DownloadSucceeded: true})
+	saved, err := ioutil.ReadFile(filepath.Join(dir, journalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put the journal back, as if we crashed between writing the
+	// snapshot and truncating the journal.
+	s.Set("example.com/code@v1.1.0", PackageStats{DownloadSucceeded: true})
+	later, err := ioutil.ReadFile(filepath.Join(dir, journalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, journalName), append(saved, later...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadLatest(); err != nil {
+		t.Fatal(err)
+	}
+	if runs, _ := restarted.History("example.com/code@v1.0.0"); len(runs) != 1 {
+		t.Errorf("Runs already in the snapshot, got %d, want 1", len(runs))
+	}
+	if runs, _ := restarted.History("example.com/code@v1.1.0"); len(runs) != 1 {
+		t.Errorf("Runs after the snapshot, got %d, want 1", len(runs))
+	}
+
+	restarted.Set("example.com/code@v1.2.0", PackageStats{})
+	if err := restarted.Save(); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := readSnapshot(latestSnapshot(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Header.JournalSeq != 3 {
+		t.Errorf("Journal sequence after restart, got %d, want 3", snap.Header.JournalSeq)
+	}
+}
+
+// Return the name of the newest snapshot in dir.
+func latestSnapshot(t *testing.T, dir string) string {
+	names, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"))
+	if err != nil || len(names) == 0 {
+		t.Fatalf("No snapshots in %s, %v", dir, err)
+	}
+	return names[len(names)-1]
+}
+
+func TestLoadLatestSkipsDamaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("example.com/code@v1.0.0", PackageStats{DownloadSucceeded: true})
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	good, _ := filepath.Glob(filepath.Join(dir, "pkgdata-*"))
+	b, err := ioutil.ReadFile(good[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer truncated snapshot, and one whose data does not
+	// match its checksum.
+	truncated := filepath.Join(dir, "pkgdata-2999-01-01T00:00:00Z")
+	ioutil.WriteFile(truncated, b[:len(b)/2], 0644)
+	tampered := filepath.Join(dir, "pkgdata-2999-01-02T00:00:00Z")
+	ioutil.WriteFile(tampered, bytes.Replace(b, []byte("true"), []byte("false"), 1), 0644)
+
+	restarted, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadLatest(); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := restarted.Get("example.com/code@v1.0.0")
+	if !ok || !got.DownloadSucceeded {
+		t.Errorf("Fallback load, got %v (found: %v)", got, ok)
+	}
+}
+
+func TestLoadLatestAllDamaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "pkgdata-2999-01-01T00:00:00Z"), []byte("{"), 0644)
+	s, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("example.com/code@v1.0.0", PackageStats{DownloadSucceeded: true})
+
+	restarted, err := NewSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadLatest(); err == nil {
+		t.Errorf("Expected an error with no readable snapshot")
+	}
+	if got, ok := restarted.Get("example.com/code@v1.0.0"); !ok || !got.DownloadSucceeded {
+		t.Errorf("Journalled package, got %v (found: %v)", got, ok)
+	}
+}
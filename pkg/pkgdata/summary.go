@@ -0,0 +1,79 @@
+package pkgdata
+
+// Headline numbers for a dataset.
+
+import (
+	"context"
+)
+
+// Headline counts for a dataset. These follow the definitions used
+// in the tables from cmd/tabulate; all but Seen, Pending,
+// DownloadFailed, TimedOut and InfraFailed only count packages that
+// downloaded.
+type Summary struct {
+	Seen           int `json:"seen"`
+	Pending        int `json:"pending"`
+	Downloaded     int `json:"downloaded"`
+	DownloadFailed int `json:"downloadFailed"`
+	TimedOut       int `json:"timedOut"`
+	InfraFailed    int `json:"infraFailed"`
+	BuildSuccess   int `json:"buildSuccess"`
+	TestSuccess    int `json:"testSuccess"`
+	NoTestTargets  int `json:"noTestTargets"`
+	AllVetsPassed  int `json:"allVetsPassed"`
+	AllFmtOK       int `json:"allFmtOK"`
+}
+
+// Count the headline numbers for all packages in a store.
+func Summarise(ctx context.Context, s Store) Summary {
+	var rv Summary
+
+	for pkg := range s.Iterate(ctx) {
+		p := pkg.Stats
+		rv.Seen++
+		if pkg.Pending {
+			rv.Pending++
+			continue
+		}
+
+		switch p.Outcome {
+		case OutcomeTimedOut:
+			rv.TimedOut++
+			continue
+		case OutcomeInfraFailure:
+			rv.InfraFailed++
+			continue
+		}
+		if !p.DownloadSucceeded {
+			rv.DownloadFailed++
+			continue
+		}
+		rv.Downloaded++
+
+		if p.AllBuildsPass {
+			rv.BuildSuccess++
+		}
+		if p.AllTestsPassed {
+			rv.TestSuccess++
+		}
+		if p.TestableTargets == 0 {
+			rv.NoTestTargets++
+		}
+		if len(p.VetPassed) > 0 && len(p.FailedVets) == 0 {
+			rv.AllVetsPassed++
+		}
+		if len(p.FailedFmt) == 0 {
+			rv.AllFmtOK++
+		}
+	}
+
+	return rv
+}
+
+// Return how much part is of whole, as a percentage.
+func Percent(whole, part int) float64 {
+	if whole == 0 {
+		return 0.0
+	}
+	return (float64(part) / float64(whole)) * 100.0
+}
@@ -0,0 +1,29 @@
+package pkgdata
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSummarise(t *testing.T) {
+	s := NewMemoryStore()
+	s.Ensure("example.com/queued@v1.0.0")
+	s.Set("example.com/code@v1.0.0", PackageStats{})
+	s.Set("example.com/code@v1.1.0", PackageStats{DownloadSucceeded: true, AllBuildsPass: true})
+	s.Set("example.com/code@v1.2.0", PackageStats{Outcome: OutcomeTimedOut})
+
+	got := Summarise(context.Background(), s)
+	want := Summary{
+		Seen:           4,
+		Pending:        1,
+		Downloaded:     1,
+		DownloadFailed: 1,
+		TimedOut:       1,
+		BuildSuccess:   1,
+		NoTestTargets:  1,
+		AllFmtOK:       1,
+	}
+	if got != want {
+		t.Errorf("Summarise, got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,501 @@
+package validation
+
+// Tracking of dispatched jobs, so we can tell whether a report
+// answers a job we actually handed out, and the queue of jobs waiting
+// for a worker.
+//
+// Every change to a job is appended, as a line of JSON, to a file in
+// the data directory. When the server starts, the file is read back,
+// so queued jobs are not lost, and jobs that were running when the
+// server stopped are queued again.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+var ErrUnknownJob = errors.New("Unknown job")
+var ErrJobMismatch = errors.New("Report does not match job")
+var ErrDuplicateReport = errors.New("Job already reported")
+var ErrNotRunning = errors.New("Job is not running")
+
+// Job states.
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateFailed    = "failed"
+	StateAbandoned = "abandoned"
+)
+
+// The name of the job file, in the data directory.
+const jobsName = "jobs"
+
+// How long a job that finished without being reported (it timed out,
+// was canceled or abandoned, or never reported) is kept, in case a
+// late report turns up for it.
+var JobRetention = 24 * time.Hour
+
+// The job file is rewritten, without the jobs we have forgotten, once
+// it has more than this many lines, and more than twice as many lines
+// as there are jobs.
+var compactAfter = 1000
+
+// A dispatched job.
+type Job struct {
+	ID         string    `json:"id"`
+	Module     string    `json:"module"`
+	Version    string    `json:"version"`
+	State      string    `json:"state"`
+	Dispatched time.Time `json:"dispatched"`
+	Updated    time.Time `json:"updated"`
+	Reported   bool      `json:"reported"`
+	// Which attempt at running the job this is, starting at 1.
+	Attempt int `json:"attempt"`
+	// A job that is to be retried is not run before this.
+	NotBefore time.Time `json:"notBefore"`
+}
+
+// The package name (module@version) the job is for. This only reads
+// fields that never change, so it is safe without jobLock.
+func (j *Job) Package() string {
+	return pkgdata.BuildPackageName(j.Module, j.Version)
+}
+
+// Return true if nothing more will happen to the job.
+func (j Job) finished() bool {
+	return j.State == StateDone || j.State == StateFailed || j.State == StateAbandoned
+}
+
+// Return true if there is no point in keeping the job any longer: it
+// has finished, and either been reported or is past JobRetention.
+func (j Job) expired(now time.Time) bool {
+	return j.finished() && (j.Reported || now.Sub(j.Updated) >= JobRetention)
+}
+
+// All of the below is protected by jobLock. Workers wait on jobCond
+// for jobs to be queued (or dispatching to be resumed, or to be told
+// to stop), and Drain waits on it for active to reach zero.
+var jobLock sync.Mutex
+var jobCond = sync.NewCond(&jobLock)
+var jobs = make(map[string]*Job)
+var pending []*Job
+var active int
+var delayed int
+var draining bool
+var paused bool
+var jobFile *os.File
+var jobPath string
+var jobLines int
+
+// How to stop each running job, by job ID, and which jobs have been
+// canceled.
+var cancels = make(map[string]context.CancelFunc)
+var canceled = make(map[string]bool)
+
+// Return a new, random, job ID.
+func newJobID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newJob(module, version string) *Job {
+	now := time.Now()
+	return &Job{
+		ID:         newJobID(),
+		Module:     module,
+		Version:    version,
+		State:      StateQueued,
+		Dispatched: now,
+		Updated:    now,
+		Attempt:    1,
+	}
+}
+
+// Queue a job, right away or, if it is not due yet, once it is due.
+// Must be called with jobLock held.
+func queueJob(job *Job) {
+	wait := time.Until(job.NotBefore)
+	if wait <= 0 {
+		pending = append(pending, job)
+		jobCond.Broadcast()
+		return
+	}
+
+	delayed++
+	time.AfterFunc(wait, func() {
+		jobLock.Lock()
+		defer jobLock.Unlock()
+		delayed--
+		pending = append(pending, job)
+		jobCond.Broadcast()
+	})
+}
+
+// Append the current state of a job to the job file, compacting the
+// file if it has grown too long. Must be called with jobLock held.
+func writeJob(job *Job) {
+	if jobFile == nil {
+		return
+	}
+
+	b, err := json.Marshal(job)
+	if err == nil {
+		_, err = jobFile.Write(append(b, '\n'))
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"job":   job.ID,
+			"error": err,
+		}).Error("Writing job state")
+		return
+	}
+
+	jobLines++
+	if jobLines > compactAfter && jobLines > 2*len(jobs) {
+		compactJobs()
+	}
+}
+
+// Replace the job file with one holding only the current state of
+// each job in keep, and append to the new file from then on. Must be
+// called with jobLock held.
+func rewriteJobs(keep []*Job) error {
+	dir := filepath.Dir(jobPath)
+	tmp, err := ioutil.TempFile(dir, ".jobs-*")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, job := range keep {
+		if err = enc.Encode(job); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), jobPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f, err := os.OpenFile(jobPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if jobFile != nil {
+		jobFile.Close()
+	}
+	jobFile = f
+	jobLines = len(keep)
+	return nil
+}
+
+// Forget expired jobs, and rewrite the job file with the jobs we still
+// know about. On failure, we carry on appending to the old file. Must
+// be called with jobLock held.
+func compactJobs() {
+	now := time.Now()
+	keep := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		forgetJob(job, now)
+		if _, ok := jobs[job.ID]; ok {
+			keep = append(keep, job)
+		}
+	}
+	sort.Slice(keep, func(i, j int) bool {
+		return keep[i].Dispatched.Before(keep[j].Dispatched)
+	})
+
+	lines := jobLines
+	if err := rewriteJobs(keep); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  jobPath,
+			"error": err,
+		}).Error("Compacting job file")
+		jobLines = 0
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"was":  lines,
+		"jobs": len(keep),
+	}).Debug("Compacted job file.")
+}
+
+// Forget a job once it has expired, as there is nothing left to check
+// against it. Must be called with jobLock held.
+func forgetJob(job *Job, now time.Time) {
+	if job.expired(now) {
+		delete(jobs, job.ID)
+	}
+}
+
+// Read a job file, returning the latest state of each job, in the
+// order they were dispatched.
+func readJobs(path string) ([]*Job, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	latest := make(map[string]*Job)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var job Job
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":  path,
+				"error": err,
+			}).Warn("Skipping damaged job entry")
+			continue
+		}
+		latest[job.ID] = &job
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var rv []*Job
+	for _, job := range latest {
+		rv = append(rv, job)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Dispatched.Before(rv[j].Dispatched)
+	})
+	return rv, nil
+}
+
+// Load the job file in dir, queue any jobs that were waiting, and
+// queue new jobs for any that were running when we last stopped. From
+// then on, job changes are written to the file.
+//
+// Jobs that have finished and been reported, or finished unreported
+// more than JobRetention ago, are dropped from the file, as there is
+// nothing left to check them against. While the server runs, reported
+// jobs are forgotten as they finish, unreported ones when the file is
+// compacted, which happens now and then.
+func OpenJobs(dir string) error {
+	path := filepath.Join(dir, jobsName)
+	loaded, err := readJobs(path)
+	if err != nil {
+		return err
+	}
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	var keep, restart []*Job
+	for _, job := range loaded {
+		switch {
+		case job.State == StateQueued:
+			queueJob(job)
+		case job.State == StateRunning && job.Reported:
+			continue
+		case job.State == StateRunning:
+			job.State = StateAbandoned
+			job.Updated = time.Now()
+			restart = append(restart, job)
+		case job.expired(time.Now()):
+			continue
+		}
+		jobs[job.ID] = job
+		keep = append(keep, job)
+	}
+	for _, old := range restart {
+		job := newJob(old.Module, old.Version)
+		logrus.WithFields(logrus.Fields{
+			"package": job.Package(),
+			"old":     old.ID,
+			"job":     job.ID,
+		}).Info("Queueing interrupted job again.")
+		jobs[job.ID] = job
+		queueJob(job)
+		keep = append(keep, job)
+	}
+
+	jobPath = path
+	if err := rewriteJobs(keep); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"queued":    len(pending),
+		"delayed":   delayed,
+		"restarted": len(restart),
+	}).Info("Loaded jobs.")
+	jobCond.Broadcast()
+	return nil
+}
+
+// Record and queue a new job.
+func addJob(module, version string) *Job {
+	job := newJob(module, version)
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	jobs[job.ID] = job
+	writeJob(job)
+	queueJob(job)
+
+	return job
+}
+
+// Wait for a queued job, and mark it as running. This blocks for as
+// long as we are paused or draining. Returns nil if the calling worker
+// should stop, as there are more workers than wanted.
+func nextJob() *Job {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	for {
+		if liveWorkers > workerCount {
+			liveWorkers--
+			return nil
+		}
+		if len(pending) > 0 && !draining && !paused {
+			break
+		}
+		jobCond.Wait()
+	}
+
+	job := pending[0]
+	pending[0] = nil
+	pending = pending[1:]
+
+	job.State = StateRunning
+	job.Updated = time.Now()
+	active++
+	writeJob(job)
+
+	return job
+}
+
+// Record how to stop a running job.
+func setCancel(job *Job, cancel context.CancelFunc) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	cancels[job.ID] = cancel
+}
+
+// Stop a running job. The job ends up abandoned.
+func CancelJob(id string) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	cancel, ok := cancels[id]
+	if !ok {
+		return ErrNotRunning
+	}
+	canceled[id] = true
+	cancel()
+	return nil
+}
+
+// Return true if a job has been canceled.
+func wasCanceled(job *Job) bool {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	return canceled[job.ID]
+}
+
+// Mark a running job as finished, in the given state.
+func finishJob(job *Job, state string) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	delete(cancels, job.ID)
+	delete(canceled, job.ID)
+	job.State = state
+	job.Updated = time.Now()
+	active--
+	writeJob(job)
+	forgetJob(job, time.Now())
+	jobCond.Broadcast()
+}
+
+// Put a running job back in the queue, to be run again after delay.
+func retryJob(job *Job, delay time.Duration) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	delete(cancels, job.ID)
+	delete(canceled, job.ID)
+	job.State = StateQueued
+	job.Attempt++
+	job.NotBefore = time.Now().Add(delay)
+	job.Updated = time.Now()
+	active--
+	writeJob(job)
+	queueJob(job)
+	jobCond.Broadcast()
+}
+
+// Return true if a report has been received for a job.
+func reported(job *Job) bool {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	return job.Reported
+}
+
+// Check a report for pkg (module@version) against the job it claims
+// to answer, and mark the job as reported. A job that has finished is
+// forgotten once reported, so any later report for it is for an
+// unknown job.
+func CompleteJob(id, pkg string) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	job, ok := jobs[id]
+	switch {
+	case !ok:
+		return ErrUnknownJob
+	case job.Package() != pkg:
+		return ErrJobMismatch
+	case job.Reported:
+		return ErrDuplicateReport
+	}
+
+	job.Reported = true
+	writeJob(job)
+	forgetJob(job, time.Now())
+	return nil
+}
+
+// Return a copy of a job, if we know about it.
+func GetJob(id string) (Job, bool) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
@@ -0,0 +1,396 @@
+package validation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+func TestCompleteJob(t *testing.T) {
+	job := addJob("example.com/code", "v1.0.0")
+
+	cases := []struct {
+		id   string
+		pkg  string
+		want error
+	}{
+		{"no-such-job", "example.com/code@v1.0.0", ErrUnknownJob},
+		{job.ID, "example.com/code@v1.1.0", ErrJobMismatch},
+		{job.ID, "example.com/code@v1.0.0", nil},
+		{job.ID, "example.com/code@v1.0.0", ErrDuplicateReport},
+	}
+
+	for ix, c := range cases {
+		if got := CompleteJob(c.id, c.pkg); got != c.want {
+			t.Errorf("Case #%d, got %v, want %v", ix, got, c.want)
+		}
+	}
+}
+
+// Forget all jobs, and stop writing them to file.
+func resetJobs() {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	if jobFile != nil {
+		jobFile.Close()
+	}
+	jobFile = nil
+	jobPath = ""
+	jobLines = 0
+	jobs = make(map[string]*Job)
+	pending = nil
+	active = 0
+	draining = false
+	paused = false
+	cancels = make(map[string]context.CancelFunc)
+	canceled = make(map[string]bool)
+}
+
+func TestOpenJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resetJobs()
+	defer resetJobs()
+
+	t0 := time.Now().Add(-time.Hour)
+	old := []Job{
+		{ID: "queued", Module: "example.com/a", Version: "v1.0.0", State: StateQueued, Dispatched: t0},
+		{ID: "running", Module: "example.com/b", Version: "v1.0.0", State: StateRunning, Dispatched: t0.Add(time.Second)},
+		{ID: "reported", Module: "example.com/c", Version: "v1.0.0", State: StateRunning, Dispatched: t0.Add(2 * time.Second), Reported: true},
+		{ID: "done", Module: "example.com/d", Version: "v1.0.0", State: StateDone, Dispatched: t0.Add(3 * time.Second), Reported: true},
+		{ID: "failed", Module: "example.com/e", Version: "v1.0.0", State: StateFailed, Dispatched: t0.Add(4 * time.Second), Updated: time.Now().Add(-time.Minute)},
+		{ID: "expired", Module: "example.com/f", Version: "v1.0.0", State: StateFailed, Dispatched: t0.Add(5 * time.Second), Updated: t0.Add(-JobRetention)},
+	}
+	var b []byte
+	for _, job := range old {
+		line, _ := json.Marshal(job)
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, jobsName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := OpenJobs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := Status().Queued; got != 2 {
+		t.Fatalf("Queued after open, got %d, want 2", got)
+	}
+	first := nextJob()
+	second := nextJob()
+	if first.ID != "queued" || second.Package() != "example.com/b@v1.0.0" || second.ID == "running" {
+		t.Errorf("Got jobs %v and %v", first, second)
+	}
+	if job, _ := GetJob("running"); job.State != StateAbandoned {
+		t.Errorf("Interrupted job, got state %s, want %s", job.State, StateAbandoned)
+	}
+	for _, id := range []string{"reported", "done", "expired"} {
+		if _, ok := GetJob(id); ok {
+			t.Errorf("Job %s was kept", id)
+		}
+	}
+	finishJob(first, StateDone)
+
+	loaded, err := readJobs(filepath.Join(dir, jobsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]string)
+	for _, job := range loaded {
+		states[job.ID] = job.State
+	}
+	want := map[string]string{"queued": StateDone, "running": StateAbandoned, "failed": StateFailed, second.ID: StateRunning}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("Job file, got %v, want %v", states, want)
+	}
+}
+
+// A runner that runs until told to stop.
+type blockingRunner chan struct{}
+
+func (r blockingRunner) Run(ctx context.Context, job *Job, env []string) error {
+	<-r
+	return nil
+}
+
+// Wait for the queue to get into a state.
+func waitFor(t *testing.T, what string, f func(QueueStatus) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !f(Status()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s, status %+v", what, Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Stop all workers, and wait for them to be gone.
+func stopWorkers(t *testing.T) {
+	SetWorkers(0)
+	waitFor(t, "all workers to stop", func(s QueueStatus) bool {
+		jobLock.Lock()
+		defer jobLock.Unlock()
+		return liveWorkers == 0
+	})
+}
+
+func TestResizeAndPause(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+
+	r := make(blockingRunner)
+	ValidationConfiguration{Runner: r}.StartWorkers(2)
+	for i := 0; i < 3; i++ {
+		addJob("example.com/code", fmt.Sprintf("v1.0.%d", i))
+	}
+	waitFor(t, "two running", func(s QueueStatus) bool { return s.Running == 2 && s.Queued == 1 })
+
+	SetWorkers(1)
+	r <- struct{}{}
+	waitFor(t, "a worker to stop", func(s QueueStatus) bool { return s.Running == 1 && s.Queued == 1 })
+
+	Pause()
+	r <- struct{}{}
+	waitFor(t, "pause", func(s QueueStatus) bool { return s.Running == 0 && s.Queued == 1 && s.Paused })
+
+	Resume()
+	waitFor(t, "resume", func(s QueueStatus) bool { return s.Running == 1 && s.Queued == 0 })
+
+	close(r)
+	stopWorkers(t)
+}
+
+// A runner that runs until its context is done.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, job *Job, env []string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Wait for a job to get into a state.
+func waitForState(t *testing.T, id, state string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, _ := GetJob(id)
+		if job.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for job %s to be %s, it is %s", id, state, job.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+
+	store := pkgdata.NewMemoryStore()
+	ValidationConfiguration{Runner: hangingRunner{}, Timeout: 10 * time.Millisecond, Store: store}.StartWorkers(1)
+	job := addJob("example.com/code", "v1.0.0")
+	waitForState(t, job.ID, StateFailed)
+	if stats, _ := store.Get(job.Package()); stats.Outcome != pkgdata.OutcomeTimedOut {
+		t.Errorf("Timed out job, got outcome %q, want %q", stats.Outcome, pkgdata.OutcomeTimedOut)
+	}
+
+	stopWorkers(t)
+	ValidationConfiguration{Runner: hangingRunner{}, Store: store}.StartWorkers(1)
+	job = addJob("example.com/code", "v1.1.0")
+	waitForState(t, job.ID, StateRunning)
+	if err := CancelJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, job.ID, StateAbandoned)
+	if _, ok := store.Get(job.Package()); ok {
+		t.Errorf("Canceled job was recorded")
+	}
+	if err := CancelJob(job.ID); err != ErrNotRunning {
+		t.Errorf("Canceling a finished job, got %v, want %v", err, ErrNotRunning)
+	}
+
+	stopWorkers(t)
+}
+
+// A runner that never reports.
+type silentRunner struct{}
+
+func (silentRunner) Run(ctx context.Context, job *Job, env []string) error {
+	return nil
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := p.delay(c.attempt); got != c.want {
+			t.Errorf("Attempt %d, got %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryWithoutReport(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+
+	store := pkgdata.NewMemoryStore()
+	retry := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	ValidationConfiguration{Runner: silentRunner{}, Store: store, Retry: retry}.StartWorkers(1)
+	defer stopWorkers(t)
+
+	job := addJob("example.com/code", "v1.0.0")
+	waitForState(t, job.ID, StateFailed)
+	if got, _ := GetJob(job.ID); got.Attempt != 3 {
+		t.Errorf("Got %d attempts, want 3", got.Attempt)
+	}
+	if stats, _ := store.Get(job.Package()); stats.Outcome != pkgdata.OutcomeInfraFailure {
+		t.Errorf("Got outcome %q, want %q", stats.Outcome, pkgdata.OutcomeInfraFailure)
+	}
+
+	job = addJob("example.com/code", "v1.1.0")
+	CompleteJob(job.ID, job.Package())
+	waitForForgotten(t, job.ID)
+	if job.Attempt != 1 || job.State != StateDone {
+		t.Errorf("Reported job, got %d attempts and state %s, want 1 and %s", job.Attempt, job.State, StateDone)
+	}
+}
+
+// Wait for a job to be forgotten.
+func waitForForgotten(t *testing.T, id string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := GetJob(id); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for job %s to be forgotten", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForgetAndCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resetJobs()
+	defer resetJobs()
+	defer func(n int) { compactAfter = n }(compactAfter)
+	compactAfter = 10
+
+	if err := OpenJobs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reported before and after finishing, and finished unreported.
+	early := addJob("example.com/code", "v1.0.0")
+	late := addJob("example.com/code", "v1.1.0")
+	failed := addJob("example.com/code", "v1.2.0")
+	for i := 0; i < 3; i++ {
+		nextJob()
+	}
+	CompleteJob(early.ID, early.Package())
+	finishJob(early, StateDone)
+	finishJob(late, StateDone)
+	CompleteJob(late.ID, late.Package())
+	finishJob(failed, StateFailed)
+
+	for _, job := range []*Job{early, late} {
+		if _, ok := GetJob(job.ID); ok {
+			t.Errorf("Finished and reported job %s was kept", job.Version)
+		}
+	}
+	if _, ok := GetJob(failed.ID); !ok {
+		t.Errorf("Unreported job was forgotten")
+	}
+	if err := CompleteJob(early.ID, early.Package()); err != ErrUnknownJob {
+		t.Errorf("Report for a forgotten job, got %v, want %v", err, ErrUnknownJob)
+	}
+
+	// The failed job is kept until it is past JobRetention, and then
+	// forgotten at the next compaction.
+	defer func(d time.Duration) { JobRetention = d }(JobRetention)
+	JobRetention = 0
+
+	for i := 0; i < 20; i++ {
+		job := addJob("example.com/more", fmt.Sprintf("v1.0.%d", i))
+		nextJob()
+		CompleteJob(job.ID, job.Package())
+		finishJob(job, StateDone)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, jobsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(b, []byte("\n")); lines > 2*compactAfter {
+		t.Errorf("Job file not compacted, %d lines", lines)
+	}
+	loaded, err := readJobs(filepath.Join(dir, jobsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Jobs written since the last compaction are still there, but
+	// would be dropped on loading.
+	var kept []string
+	for _, job := range loaded {
+		if !job.expired(time.Now()) {
+			kept = append(kept, job.ID)
+		}
+	}
+	if len(kept) != 0 {
+		t.Errorf("Job file, got unreported jobs %v, want none", kept)
+	}
+	if _, ok := GetJob(failed.ID); ok {
+		t.Errorf("Expired job was kept")
+	}
+}
+
+func TestStartWhileDraining(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ValidationConfiguration{Runner: silentRunner{}}.StartWorkers(1)
+	defer stopWorkers(t)
+	ValidationConfiguration{}.Start("example.com/code", "v1.0.0")
+
+	time.Sleep(10 * time.Millisecond)
+	if s := Status(); s.Queued != 1 || s.Running != 0 {
+		t.Errorf("While draining, got %d queued and %d running, want 1 and 0", s.Queued, s.Running)
+	}
+}
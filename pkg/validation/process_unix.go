@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package validation
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start cmd in a process group of its own.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill a started command, and everything in its process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
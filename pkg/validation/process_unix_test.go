@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package validation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Return true if a process has exited (it may be a zombie, waiting to
+// be reaped by whoever inherited it).
+func exited(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestProcessRunnerKillsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// The command starts a child that outlives it, unless killed.
+	r := &ProcessRunner{Command: []string{"sh", "-c", "sleep 60 & echo $! > " + pidFile + "; wait"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	job := &Job{ID: "1234", Module: "example.com/code", Version: "v1.0.0"}
+	if err := r.Run(ctx, job, nil); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !exited(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Child %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
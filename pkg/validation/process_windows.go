@@ -0,0 +1,14 @@
+package validation
+
+import (
+	"os/exec"
+)
+
+// There are no process groups to speak of here.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Kill a started command. Anything it started is left running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
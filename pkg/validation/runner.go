@@ -0,0 +1,236 @@
+package validation
+
+// Ways of running a build job.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/pkgdata"
+)
+
+// Something that can run a build job to completion. The builder is
+// expected to report its results to the report endpoint on its own.
+// env holds the variables (GOCHECKER_JOB_ID and, possibly,
+// GOCHECKER_JOB_KEY) the builder needs, as NAME=value.
+type Runner interface {
+	Run(ctx context.Context, job *Job, env []string) error
+}
+
+// The runner kinds NewRunner knows about.
+var RunnerKinds = []string{"docker", "podman", "local", "fake"}
+
+// Return a runner of the given kind, set up from c.
+func NewRunner(kind string, c ValidationConfiguration) (Runner, error) {
+	switch kind {
+	case "docker", "podman":
+		return &ContainerRunner{Binary: kind, Image: c.Image, EnvFile: c.EnvFile, Endpoint: c.Endpoint}, nil
+	case "local":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("The local runner needs a command")
+		}
+		return &ProcessRunner{Command: c.Command, Endpoint: c.Endpoint}, nil
+	case "fake":
+		return &FakeRunner{Endpoint: c.Endpoint, ReportToken: c.ReportToken}, nil
+	}
+	return nil, fmt.Errorf("Unknown runner, %s, should be one of %s", kind, strings.Join(RunnerKinds, ", "))
+}
+
+// Return the value of name in env, or an empty string.
+func envValue(env []string, name string) string {
+	for _, v := range env {
+		if strings.HasPrefix(v, name+"=") {
+			return strings.TrimPrefix(v, name+"=")
+		}
+	}
+	return ""
+}
+
+// Runs the build image in a container, with docker or something with
+// the same command line (like podman).
+type ContainerRunner struct {
+	Binary   string
+	Image    string
+	EnvFile  string
+	Endpoint string
+}
+
+// The name of the container a job runs in.
+func containerName(job *Job) string {
+	return "gochecker-" + job.ID
+}
+
+// The command line for running a job. Only the names of the job
+// variables go on the command line, so the job key does not end up in
+// logs or in ps output; the container client reads the values from
+// its own environment.
+func (r *ContainerRunner) args(job *Job, env []string) []string {
+	args := []string{r.Binary, "run", "--rm", "--name", containerName(job), "--env-file", r.EnvFile}
+	for _, v := range env {
+		args = append(args, "--env", strings.SplitN(v, "=", 2)[0])
+	}
+	return append(args, r.Image, job.Module, job.Version, r.Endpoint)
+}
+
+// Run a job in a container. If ctx is done before the container
+// exits, the container is removed by force; killing the client alone
+// would leave the container running.
+func (r *ContainerRunner) Run(ctx context.Context, job *Job, env []string) error {
+	args := r.args(job, env)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	logrus.WithFields(logrus.Fields{
+		"args": cmd.Args,
+	}).Info("Spawning external checker.")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	out, err := exec.Command(r.Binary, "rm", "--force", containerName(job)).CombinedOutput()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"container": containerName(job),
+			"error":     err,
+			"output":    string(out),
+		}).Error("Removing container.")
+	}
+	cmd.Process.Kill()
+	<-done
+	return ctx.Err()
+}
+
+// Runs a command directly on the host, with module, version and
+// report endpoint as its last three arguments. The command inherits
+// our environment.
+type ProcessRunner struct {
+	Command  []string
+	Endpoint string
+}
+
+// Run a job as a local command. The command gets a process group of
+// its own, and if ctx is done before it exits, the whole group is
+// killed; killing the command alone would leave whatever it started
+// (like a hung go test) running.
+func (r *ProcessRunner) Run(ctx context.Context, job *Job, env []string) error {
+	args := append(append([]string{}, r.Command...), job.Module, job.Version, r.Endpoint)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	setProcessGroup(cmd)
+	logrus.WithFields(logrus.Fields{
+		"args": cmd.Args,
+	}).Info("Spawning external checker.")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if err := killProcessGroup(cmd); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"pid":   cmd.Process.Pid,
+			"error": err,
+		}).Error("Killing checker.")
+	}
+	<-done
+	return ctx.Err()
+}
+
+// Runs nothing, and reports made-up results instead, for testing the
+// server without building anything. The results only depend on the
+// package name, so the same package always gets the same results.
+type FakeRunner struct {
+	Endpoint    string
+	ReportToken string
+}
+
+// Make up results for a package.
+func fakeStats(pkg string) pkgdata.PackageStats {
+	sum := sha256.Sum256([]byte(pkg))
+	roll := sum[0] % 10
+
+	var rv pkgdata.PackageStats
+	if roll == 0 {
+		return rv
+	}
+	rv.DownloadSucceeded = true
+	rv.BuildableTargets = 1
+	rv.TestableTargets = 1
+	rv.AllBuildsPass = roll > 2
+	rv.AllTestsPassed = roll > 4
+	rv.VetPassed = []string{"."}
+	switch {
+	case !rv.AllBuildsPass:
+		rv.FailedBuilds = []string{"."}
+		rv.Failures = []pkgdata.Failure{{Target: ".", Stage: pkgdata.StageBuild, Cause: pkgdata.CauseTypeError}}
+	case !rv.AllTestsPassed:
+		rv.FailedTests = []string{"."}
+		rv.Failures = []pkgdata.Failure{{Target: ".", Stage: pkgdata.StageTest, Cause: pkgdata.CauseTestFailure}}
+	}
+	return rv
+}
+
+func (r *FakeRunner) Run(ctx context.Context, job *Job, env []string) error {
+	payload := struct {
+		Package   string               `json:"package"`
+		JobID     string               `json:"jobId"`
+		Toolchain string               `json:"toolchain"`
+		Data      pkgdata.PackageStats `json:"data"`
+	}{job.Package(), envValue(env, "GOCHECKER_JOB_ID"), "fake", fakeStats(job.Package())}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.ReportToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.ReportToken)
+	}
+	if key := envValue(env, "GOCHECKER_JOB_KEY"); key != "" {
+		req.Header.Set(auth.SignatureHeader, auth.Sign(key, b))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Report for %s got status %s", job.Package(), resp.Status)
+	}
+	return nil
+}
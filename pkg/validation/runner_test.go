@@ -0,0 +1,122 @@
+package validation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/auth"
+)
+
+func TestContainerArgs(t *testing.T) {
+	c := ValidationConfiguration{Image: "gobuilder:manual", EnvFile: "/env", Endpoint: "http://host/api/report", SigningKey: "secret"}
+	r, err := NewRunner("podman", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{ID: "1234", Module: "example.com/code", Version: "v1.0.0"}
+	got := r.(*ContainerRunner).args(job, c.environment(job))
+	want := []string{
+		"podman", "run", "--rm", "--name", "gochecker-1234", "--env-file", "/env",
+		"--env", "GOCHECKER_JOB_ID",
+		"--env", "GOCHECKER_JOB_KEY",
+		"gobuilder:manual", "example.com/code", "v1.0.0", "http://host/api/report",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	for _, kind := range []string{"local", "bogus"} {
+		if _, err := NewRunner(kind, c); err == nil {
+			t.Errorf("NewRunner(%q), expected an error", kind)
+		}
+	}
+}
+
+// The job key must reach the container client through its
+// environment, and never show up in the logged command line.
+func TestContainerKeyNotLogged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := filepath.Join(dir, "docker")
+	script := "#!/bin/sh\nprintf %s \"$GOCHECKER_JOB_KEY\" > " + filepath.Join(dir, "key") + "\n"
+	if err := ioutil.WriteFile(client, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	logrus.SetOutput(&logged)
+	defer logrus.SetOutput(os.Stderr)
+
+	c := ValidationConfiguration{Image: "gobuilder:manual", EnvFile: "/env", Endpoint: "http://host/api/report", SigningKey: "secret"}
+	job := &Job{ID: "1234", Module: "example.com/code", Version: "v1.0.0"}
+	key := auth.JobKey("secret", job.ID, job.Package())
+	r := &ContainerRunner{Binary: client, Image: c.Image, EnvFile: c.EnvFile, Endpoint: c.Endpoint}
+	if err := r.Run(context.Background(), job, c.environment(job)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logged.String(), "Spawning external checker") {
+		t.Fatalf("Command line was not logged, got %q", logged.String())
+	}
+	if strings.Contains(logged.String(), key) {
+		t.Errorf("Job key in log, %q", logged.String())
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != key {
+		t.Errorf("Client got key %q, want %q", got, key)
+	}
+}
+
+func TestFakeRunner(t *testing.T) {
+	job := &Job{ID: "1234", Module: "example.com/code", Version: "v1.0.0"}
+	c := ValidationConfiguration{SigningKey: "secret", ReportToken: "token"}
+
+	var got struct {
+		Package string `json:"package"`
+		JobID   string `json:"jobId"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := (auth.Config{SigningKey: "secret"}).CheckSignature(r, b, job.ID, job.Package()); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.Unmarshal(b, &got)
+	}))
+	defer server.Close()
+
+	c.Endpoint = server.URL
+	r, err := NewRunner("fake", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), job, c.environment(job)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Package != job.Package() || got.JobID != job.ID {
+		t.Errorf("Got report for %s, job %s", got.Package, got.JobID)
+	}
+}
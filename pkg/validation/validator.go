@@ -3,72 +3,333 @@ package validation
 // A package to ensure that we can spin up the external validator
 
 import (
-	"os/exec"
+	"context"
+	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/vatine/gochecker/pkg/auth"
+	"github.com/vatine/gochecker/pkg/events"
+	"github.com/vatine/gochecker/pkg/metrics"
+	"github.com/vatine/gochecker/pkg/pkgdata"
 )
 
 type ValidationConfiguration struct {
 	Image    string
 	EnvFile  string
 	Endpoint string
+	// If set, each job is passed a key derived from this, to sign
+	// its report with.
+	SigningKey string
+	// The command the local runner runs.
+	Command []string
+	// The token the fake runner reports with.
+	ReportToken string
+	// What runs the jobs, a docker ContainerRunner if not set.
+	Runner Runner
+	// How long a job may run before it is killed, 0 for no limit.
+	Timeout time.Duration
+	// Where to record runs that end without a report, if set.
+	Store pkgdata.Store
+	// How to retry jobs that end without a report.
+	Retry RetryPolicy
 }
 
-type execBlob struct {
-	args []string
+// How to retry jobs that end without a report. Those are most likely
+// down to the build infrastructure (the container failing to start,
+// the builder not reaching us) rather than the module, so they are
+// worth another go.
+type RetryPolicy struct {
+	// Most attempts at running a job, 0 or 1 to not retry.
+	MaxAttempts int
+	// How long to wait before the first retry, doubling for each
+	// retry after that.
+	Backoff time.Duration
+	// Longest to wait between attempts.
+	MaxBackoff time.Duration
 }
 
-var execChan chan execBlob
+// Return how long to wait before running a job again, after attempt
+// failed.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
 
-func init() {
-	execChan = startRunLoop()
+// Publish a job lifecycle event.
+func publish(eventType string, job *Job) {
+	events.Publish(events.Event{
+		Type:    eventType,
+		Package: job.Package(),
+		Data: struct {
+			JobID string `json:"jobId"`
+		}{job.ID},
+	})
 }
 
-// Starts multiple loops consuming one execution item at a time. Returns the
-// chan execBlob that things to be run will be sent over.
-func startRunLoop() chan execBlob {
-	c := make(chan execBlob)
+// The number of workers we want, and the number running, both
+// protected by jobLock. Surplus workers stop once they are between
+// jobs, so resizing never interrupts a running job.
+var workerCount int
+var liveWorkers int
+
+// The configuration new workers are started with.
+var workerConfig ValidationConfiguration
 
-	go runLoop(c)
-	go runLoop(c)
-	go runLoop(c)
+var jobsQueued = metrics.NewCounter("gochecker_jobs_queued_total", "Validation jobs queued.")
+var jobsStarted = metrics.NewCounter("gochecker_jobs_started_total", "Validation jobs started.")
+var jobsFinished = metrics.NewCounter("gochecker_jobs_finished_total", "Validation jobs that ran to completion.")
+var jobsFailed = metrics.NewCounter("gochecker_jobs_failed_total", "Validation jobs that failed to start or exited with an error.")
+var jobsTimedOut = metrics.NewCounter("gochecker_jobs_timed_out_total", "Validation jobs killed for running too long.")
+var jobsCanceled = metrics.NewCounter("gochecker_jobs_canceled_total", "Validation jobs canceled by an admin.")
+var jobsRetried = metrics.NewCounter("gochecker_jobs_retried_total", "Validation jobs queued again after ending without a report.")
+var jobsInfraFailed = metrics.NewCounter("gochecker_jobs_infra_failed_total", "Validation jobs given up on after never reporting.")
 
-	return c
+func init() {
+	metrics.NewGaugeFunc("gochecker_queue_depth", "Validation jobs waiting for a worker.", func() float64 {
+		return float64(Status().Queued)
+	})
+	metrics.NewGaugeFunc("gochecker_retrying_jobs", "Validation jobs waiting to be retried.", func() float64 {
+		return float64(Status().Retrying)
+	})
+	metrics.NewGaugeFunc("gochecker_busy_workers", "Workers running a validation job.", func() float64 {
+		return float64(Status().Running)
+	})
 }
 
-// Runs a loop, consuming one item at a time from c, finishing (if at
-// all) when c is closed.
-func runLoop(c chan execBlob) {
-	for blob := range c {
-		logrus.WithFields(logrus.Fields{
-			"args": blob.args,
-		}).Info("Spawning external checker.")
-		cmd := exec.Command(blob.args[0], blob.args[1:]...)
-
-		err := cmd.Start()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{}).Error("Failed to spawn external command.")
-		} else {
-			cmd.Wait()
-			logrus.WithFields(logrus.Fields{
-				"args": blob.args,
-			}).Info("Check complete")
-		}
+// The state of the job queue.
+type QueueStatus struct {
+	Queued   int64 `json:"queued"`
+	Retrying int64 `json:"retrying"`
+	Running  int64 `json:"running"`
+	Workers  int   `json:"workers"`
+	Paused   bool  `json:"paused"`
+}
+
+// Return the current state of the job queue.
+func Status() QueueStatus {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	return QueueStatus{
+		Queued:   int64(len(pending)),
+		Retrying: int64(delayed),
+		Running:  int64(active),
+		Workers:  workerCount,
+		Paused:   paused,
 	}
 }
 
-// Start an externa validation run, this essentialy boils down to
-// doing a docker run of the image we care about, with the environment
-// file we care about.
-// Return immediately, spawn a goroutine to wait for the child process
-func (c ValidationConfiguration) Start(module, version string) error {
+// Stop dispatching jobs and wait for the running ones to finish, or
+// for ctx to be done. Queued jobs, including any queued from now on,
+// stay queued, and are run when the server is started again.
+func Drain(ctx context.Context) error {
+	jobLock.Lock()
+	draining = true
+	jobLock.Unlock()
+
+	done := make(chan struct{})
 	go func() {
-		execChan <- execBlob{
-			[]string{
-				"docker", "run", "--rm", "--env-file",
-				c.EnvFile, c.Image, module, version, c.Endpoint,
-			},
+		jobLock.Lock()
+		for active > 0 {
+			jobCond.Wait()
 		}
+		jobLock.Unlock()
+		close(done)
 	}()
-	return nil
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Starts n loops running one queued job at a time, with this
+// configuration.
+func (c ValidationConfiguration) StartWorkers(n int) {
+	jobLock.Lock()
+	workerConfig = c
+	jobLock.Unlock()
+
+	SetWorkers(n)
+}
+
+// Change the number of workers. Extra workers are started right away;
+// surplus workers finish their current job first.
+func SetWorkers(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	workerCount = n
+	for liveWorkers < workerCount {
+		liveWorkers++
+		go workerConfig.runLoop()
+	}
+	jobCond.Broadcast()
+
+	logrus.WithFields(logrus.Fields{
+		"workers": n,
+	}).Info("Set number of workers.")
+}
+
+// Stop starting new jobs, until Resume is called. Running jobs are
+// left to finish.
+func Pause() {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	paused = true
+	logrus.Info("Paused dispatching jobs.")
+}
+
+// Start dispatching jobs again.
+func Resume() {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	paused = false
+	jobCond.Broadcast()
+	logrus.Info("Resumed dispatching jobs.")
+}
+
+// The environment a job's builder needs. The job ID is passed to the
+// builder in GOCHECKER_JOB_ID, and the builder has to send it back
+// with its report.
+func (c ValidationConfiguration) environment(job *Job) []string {
+	env := []string{"GOCHECKER_JOB_ID=" + job.ID}
+	if c.SigningKey != "" {
+		env = append(env, "GOCHECKER_JOB_KEY="+auth.JobKey(c.SigningKey, job.ID, job.Package()))
+	}
+	return env
+}
+
+// Return the context a job runs in.
+func (c ValidationConfiguration) jobContext() (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(context.Background(), c.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Record a run that ended without a report, unless the builder
+// managed to report after all.
+func (c ValidationConfiguration) recordOutcome(job *Job, outcome string) {
+	if c.Store == nil || reported(job) {
+		return
+	}
+
+	c.Store.AddRun(job.Package(), pkgdata.RunRecord{
+		Time:  time.Now(),
+		Image: c.Image,
+		Stats: pkgdata.PackageStats{Outcome: outcome},
+	})
+}
+
+// Runs a loop, running one queued job at a time, until there are more
+// workers than we want.
+func (c ValidationConfiguration) runLoop() {
+	runner := c.Runner
+	if runner == nil {
+		runner = &ContainerRunner{Binary: "docker", Image: c.Image, EnvFile: c.EnvFile, Endpoint: c.Endpoint}
+	}
+
+	for {
+		job := nextJob()
+		if job == nil {
+			return
+		}
+		jobsStarted.Inc()
+		publish(events.JobStarted, job)
+
+		ctx, cancel := c.jobContext()
+		setCancel(job, cancel)
+		err := runner.Run(ctx, job, c.environment(job))
+		ctxErr := ctx.Err()
+		cancel()
+
+		switch {
+		case ctxErr == context.DeadlineExceeded:
+			jobsTimedOut.Inc()
+			publish(events.JobTimedOut, job)
+			c.recordOutcome(job, pkgdata.OutcomeTimedOut)
+			finishJob(job, StateFailed)
+			logrus.WithFields(logrus.Fields{
+				"package": job.Package(),
+				"job":     job.ID,
+				"timeout": c.Timeout,
+			}).Warn("Check timed out.")
+			continue
+		case ctxErr == context.Canceled && wasCanceled(job):
+			jobsCanceled.Inc()
+			publish(events.JobCanceled, job)
+			finishJob(job, StateAbandoned)
+			logrus.WithFields(logrus.Fields{
+				"package": job.Package(),
+				"job":     job.ID,
+			}).Info("Check canceled.")
+			continue
+		case !reported(job) && job.Attempt < c.Retry.MaxAttempts:
+			delay := c.Retry.delay(job.Attempt)
+			jobsRetried.Inc()
+			publish(events.JobRetrying, job)
+			logrus.WithFields(logrus.Fields{
+				"package": job.Package(),
+				"job":     job.ID,
+				"attempt": job.Attempt,
+				"delay":   delay,
+				"error":   err,
+			}).Warn("Check ended without a report, retrying.")
+			retryJob(job, delay)
+			continue
+		case !reported(job):
+			jobsInfraFailed.Inc()
+			publish(events.JobFailed, job)
+			c.recordOutcome(job, pkgdata.OutcomeInfraFailure)
+			finishJob(job, StateFailed)
+			logrus.WithFields(logrus.Fields{
+				"package":  job.Package(),
+				"job":      job.ID,
+				"attempts": job.Attempt,
+				"error":    err,
+			}).Error("Check never reported, giving up.")
+			continue
+		case err != nil:
+			jobsFailed.Inc()
+			publish(events.JobFailed, job)
+			finishJob(job, StateFailed)
+			logrus.WithFields(logrus.Fields{
+				"package": job.Package(),
+				"job":     job.ID,
+				"error":   err,
+			}).Error("Check failed.")
+			continue
+		}
+
+		jobsFinished.Inc()
+		publish(events.JobFinished, job)
+		finishJob(job, StateDone)
+		logrus.WithFields(logrus.Fields{
+			"package": job.Package(),
+			"job":     job.ID,
+		}).Info("Check complete")
+	}
+}
+
+// Queue an external validation run, to be picked up by a worker.
+// Return immediately. While draining, the job is queued all the same,
+// and kept for the next start.
+func (c ValidationConfiguration) Start(module, version string) {
+	job := addJob(module, version)
+	jobsQueued.Inc()
+	publish(events.JobQueued, job)
 }
@@ -6,9 +6,15 @@ import sys
 
 def load_data(filename):
     with open(filename) as in_file:
-        return json.load(in_file)
+        data = json.load(in_file)
+    if 'header' in data:
+        return data['packages']
+    return data
         
     
+# These run the builder by hand, so the server needs to be started
+# with --allow-manual-reports to accept the results.
+
 def rescan(data):
     for pkg in sorted(data):
         if not data[pkg]['downloadSucceeded']:
@@ -1,5 +1,7 @@
 #! /usr/bin/python3
 
+import hashlib
+import hmac
 import json
 import logging
 import os
@@ -16,6 +18,26 @@ VET_TYPE_RE = re.compile(
     r'cannot use .* as type .* in argument'
     )
 
+# Failure causes, checked in order, the first match wins. These need
+# to be kept in sync with the Cause* constants in pkg/pkgdata.
+FAILURE_CAUSES = [
+    ('test-timeout', re.compile(r'panic: test timed out')),
+    ('import-cycle', re.compile(r'import cycle not allowed')),
+    ('build-constraints', re.compile(r'build constraints exclude all Go files')),
+    ('missing-dependency', re.compile(
+        r'cannot find package|no required module provides package|'
+        r'cannot find module providing package|missing go[.]sum entry')),
+    ('cgo-toolchain', re.compile(
+        r'C compiler .* not found|exec: "g?cc"|pkg-config|'
+        r'fatal error: .*[.]h: No such file')),
+    ('network-access', re.compile(
+        r'dial tcp|no such host|connection refused|network is unreachable')),
+    ('panic', re.compile(r'^panic: ', re.MULTILINE)),
+    ('type-error', re.compile(
+        r'cannot use .* as|undefined: |has no field or method|'
+        r'too many arguments|not enough arguments|mismatched types')),
+]
+
 def unused_download(pkg, version):
     """
     Download a module.
@@ -129,13 +151,86 @@ def download(pkg, version):
 
 
 def go(operation, pkg):
+    """
+    Run a go command on a package, return a tuple of success and the
+    combined output.
+    """
     logging.debug("Running go %s %s", operation, pkg)
     build_dir = pkg_cwd('buildmod', 'ignore')
-    proc = subprocess.run(['go', operation, pkg], cwd=build_dir)
-    return proc.returncode == 0
+    proc = subprocess.run(['go', operation, pkg], cwd=build_dir, stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+    out = proc.stdout.decode('utf-8', errors='replace')
+    logging.debug("  output is %s", out)
+    return proc.returncode == 0, out
+
 
+def classify(stage, out):
+    """
+    Work out why a go command failed, from its output.
+    """
+    for cause, regexp in FAILURE_CAUSES:
+        if regexp.search(out):
+            return cause
+    if stage == 'test' and '--- FAIL' in out:
+        return 'test-failure'
+    if stage == 'vet':
+        return 'vet-finding'
+    return 'unknown'
 
-def test_and_build(pkg, version):
+
+def auth_headers():
+    """
+    Return the headers authenticating us to the report server, from
+    the GOCHECKER_REPORT_TOKEN environment variable.
+    """
+    token = os.environ.get('GOCHECKER_REPORT_TOKEN')
+    if token:
+        return {'Authorization': f'Bearer {token}'}
+    return {}
+
+
+def sign(body):
+    """
+    Sign a report body with the job key we were started with, if any.
+    """
+    key = os.environ.get('GOCHECKER_JOB_KEY')
+    if not key:
+        return {}
+    digest = hmac.new(key.encode('utf-8'), body, hashlib.sha256).hexdigest()
+    return {'X-Gochecker-Signature': f'sha256={digest}'}
+
+
+def logs_url(url):
+    """
+    Work out the log upload endpoint from the report endpoint.
+    """
+    return url.rsplit('/', 1)[0] + '/logs'
+
+
+def upload_log(url, pkg, out):
+    """
+    Upload the output of a failed command, return the log ID, or None
+    if the upload failed.
+    """
+    if not url:
+        return None
+    try:
+        resp = requests.post(logs_url(url), params={'package': pkg}, data=out.encode('utf-8'), headers=auth_headers())
+        resp.raise_for_status()
+        return resp.json()['id']
+    except (requests.RequestException, ValueError, KeyError) as e:
+        logging.warning("Failed to upload log: %s", e)
+        return None
+
+
+def failure(target, stage, out, url=None, pkg=None):
+    rv = {'target': target, 'stage': stage, 'cause': classify(stage, out)}
+    log_id = upload_log(url, pkg, out)
+    if log_id:
+        rv['log'] = log_id
+    return rv
+
+
+def test_and_build(pkg, version, url=None):
     output = {}
     
     output['downloadSucceeded'], cont = download(pkg, version)
@@ -153,6 +248,7 @@ def test_and_build(pkg, version):
     vet_passed = []
     failed_vets = []
     fmt_failed = []
+    failures = []
     if not cont:
         logging.info("Download succeeded, nothing to build.")
         return output
@@ -166,25 +262,29 @@ def test_and_build(pkg, version):
                 fmt_failed.append(target)
             logging.debug("  Building go target %s", target['ImportPath'])
             buildable_targets += 1
-            if go('build', target['ImportPath']):
+            ok, out = go('build', target['ImportPath'])
+            if ok:
                 logging.debug("    Success building %s", target['ImportPath'])
             else:
                 all_builds_pass = False
                 logging.debug("    Build of %s failed", target['ImportPath'])
                 failed_builds.append(target['ImportPath'])
-            if go('vet', target['ImportPath']):
+                failures.append(failure(target['ImportPath'], 'build', out, url, pkg_and_version(pkg, version)))
+            ok, out = go('vet', target['ImportPath'])
+            if ok:
                 vet_passed.append(target['ImportPath'])
             else:
                 failed_vets.append(target['ImportPath'])
+                failures.append(failure(target['ImportPath'], 'vet', out, url, pkg_and_version(pkg, version)))
 
         if len(target.get('TestGoFiles', [])):
             logging.debug("  Testing go target %s", target['ImportPath'])
             testable_targets += 1
-            if go('test', target['ImportPath']):
-                pass
-            else:
+            ok, out = go('test', target['ImportPath'])
+            if not ok:
                 all_tests_pass = False
                 failed_tests.append(target['ImportPath'])
+                failures.append(failure(target['ImportPath'], 'test', out, url, pkg_and_version(pkg, version)))
 
     output['buildableTargets'] = buildable_targets
     output['allBuildsPass'] = all_builds_pass
@@ -195,20 +295,37 @@ def test_and_build(pkg, version):
     output['passedVets'] = vet_passed
     output['failedVets'] = failed_vets
     output['failedFmt'] = fmt_failed
+    output['failures'] = failures
 
     return output
 
 
+def go_version():
+    """
+    Return the version of the Go toolchain doing the builds.
+    """
+    proc = subprocess.run(['go', 'env', 'GOVERSION'], stdout=subprocess.PIPE)
+    if proc.returncode != 0:
+        return ''
+    return proc.stdout.decode('utf-8').strip()
+
+
 def send_report(url, pkg, version, data):
     payload = { 'package': pkg_and_version(pkg, version),
+                'jobId': os.environ.get('GOCHECKER_JOB_ID', ''),
+                'toolchain': go_version(),
                 'data': data
     }
 
-    requests.post(url, json=payload)
+    body = json.dumps(payload).encode('utf-8')
+    headers = {'Content-Type': 'application/json'}
+    headers.update(auth_headers())
+    headers.update(sign(body))
+    requests.post(url, data=body, headers=headers)
 
 
 def process(pkg, version, url):
-    data = test_and_build(pkg, version)
+    data = test_and_build(pkg, version, url)
     send_report(url, pkg, version, data)
 
 